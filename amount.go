@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// parseAmount parses a decimal amount such as 1.5 into units of 10^-decimals.
+func parseAmount(s string, decimals uint) (*big.Int, error) {
+	str := strings.TrimSpace(s)
+	whole, frac := str, ""
+	if i := strings.Index(str, "."); i >= 0 {
+		whole, frac = str[:i], str[i+1:]
+	}
+	frac = strings.TrimRight(frac, "0")
+	if uint(len(frac)) > decimals {
+		return nil, fmt.Errorf("invalid amount %q: more than %d decimals", s, decimals)
+	}
+	digits := whole + frac + strings.Repeat("0", int(decimals)-len(frac))
+	if whole == "" || strings.ContainsAny(digits, "+-") {
+		return nil, fmt.Errorf("invalid amount %q", s)
+	}
+	n, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid amount %q", s)
+	}
+	return n, nil
+}
+
+// formatUnits formats an amount in units of 10^-decimals as a decimal
+// without trailing zeros. It is exact for any number of decimals and the
+// inverse of parseAmount.
+func formatUnits(amount *big.Int, decimals uint) string {
+	digits := new(big.Int).Abs(amount).String()
+	if pad := int(decimals) + 1 - len(digits); pad > 0 {
+		digits = strings.Repeat("0", pad) + digits
+	}
+	point := len(digits) - int(decimals)
+	str := digits[:point]
+	if frac := strings.TrimRight(digits[point:], "0"); frac != "" {
+		str += "." + frac
+	}
+	if amount.Sign() < 0 {
+		str = "-" + str
+	}
+	return str
+}
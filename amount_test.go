@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math/big"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestFormatParseRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	max := new(big.Int).Lsh(big.NewInt(1), 256)
+	for decimals := uint(0); decimals <= 77; decimals++ {
+		amounts := []*big.Int{big.NewInt(0), big.NewInt(1), new(big.Int).Sub(max, big.NewInt(1))}
+		for i := 0; i < 200; i++ {
+			amounts = append(amounts, new(big.Int).Rand(r, new(big.Int).Lsh(big.NewInt(1), uint(r.Intn(257)))))
+		}
+		for _, amount := range amounts {
+			for _, a := range []*big.Int{amount, new(big.Int).Neg(amount)} {
+				s := formatUnits(a, decimals)
+				if a.Sign() < 0 {
+					// parseAmount only accepts non-negative amounts.
+					if abs, err := parseAmount(strings.TrimPrefix(s, "-"), decimals); err != nil || abs.CmpAbs(a) != 0 {
+						t.Fatalf("formatUnits(%s, %d) = %q, parsed back as %v, %v", a, decimals, s, abs, err)
+					}
+					continue
+				}
+				got, err := parseAmount(s, decimals)
+				if err != nil || got.Cmp(a) != 0 {
+					t.Fatalf("formatUnits(%s, %d) = %q, parsed back as %v, %v", a, decimals, s, got, err)
+				}
+				if strings.Contains(s, ".") && strings.HasSuffix(s, "0") {
+					t.Fatalf("formatUnits(%s, %d) = %q has trailing zeros", a, decimals, s)
+				}
+			}
+		}
+	}
+}
+
+func FuzzParseAmount(f *testing.F) {
+	for _, s := range []string{"0", "1.5", "0.000000000000000001", ".5", "1.", "-1", "+1", "1e18", " 2.50 "} {
+		f.Add(s, uint(18))
+	}
+	f.Fuzz(func(t *testing.T, s string, decimals uint) {
+		decimals %= 78
+		n, err := parseAmount(s, decimals)
+		if err != nil {
+			return
+		}
+		if n.Sign() < 0 {
+			t.Fatalf("parseAmount(%q, %d) = %s is negative", s, decimals, n)
+		}
+		back, err := parseAmount(formatUnits(n, decimals), decimals)
+		if err != nil || back.Cmp(n) != 0 {
+			t.Fatalf("parseAmount(%q, %d) = %s does not round-trip: %v, %v", s, decimals, n, back, err)
+		}
+	})
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// auditEntry is a line of the audit log. Hash commits to every other field
+// and to the hash of the previous entry.
+type auditEntry struct {
+	Seq    uint64            `json:"seq"`
+	Time   time.Time         `json:"time"`
+	Action string            `json:"action"`
+	Data   map[string]string `json:"data"`
+	Prev   common.Hash       `json:"prev"`
+	Hash   common.Hash       `json:"hash"`
+	Sig    hexutil.Bytes     `json:"sig,omitempty"`
+}
+
+// digest returns the hash of e.
+func (e *auditEntry) digest() (common.Hash, error) {
+	body := *e
+	body.Hash = common.Hash{}
+	body.Sig = nil
+	data, err := json.Marshal(&body)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return crypto.Keccak256Hash(data), nil
+}
+
+// auditHead is the last entry written, saved next to the log so that a
+// truncated log can be detected.
+type auditHead struct {
+	Seq  uint64        `json:"seq"`
+	Hash common.Hash   `json:"hash"`
+	Sig  hexutil.Bytes `json:"sig,omitempty"`
+}
+
+// auditLog is an append-only hash-chained log of operator actions. The
+// processes sharing a log, the daemon jobs, take turns appending to it
+// under an flock.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	key  *ecdsa.PrivateKey
+	last auditHead
+	// off is the length of the log read so far.
+	off int64
+}
+
+// auditor is the audit log of the process, nil when disabled.
+var auditor *auditLog
+
+// openAuditLog opens the log at path for appending, resuming its chain after
+// checking it against the head file. Every entry is signed with key when set.
+func openAuditLog(path string, key *ecdsa.PrivateKey) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &auditLog{path: path, f: f, key: key}
+	if err := l.lock(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	err = l.catchUp()
+	l.unlock()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// lock waits for the other processes appending to the log.
+func (l *auditLog) lock() error {
+	if err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("%s: %v", l.path, err)
+	}
+	return nil
+}
+
+func (l *auditLog) unlock() {
+	syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+}
+
+// catchUp reads the entries appended since the last read, by this process
+// or another one, and checks the log against its head file. The log must
+// be locked.
+func (l *auditLog) catchUp() error {
+	if _, err := l.f.Seek(l.off, io.SeekStart); err != nil {
+		return err
+	}
+	err := readAuditChain(l.f, l.last, func(e *auditEntry) error {
+		l.last = auditHead{Seq: e.Seq, Hash: e.Hash}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v", l.path, err)
+	}
+	// The entries were read up to the end of the log.
+	if l.off, err = l.f.Seek(0, io.SeekCurrent); err != nil {
+		return err
+	}
+	return l.checkHead()
+}
+
+// checkHead refuses to resume a log that does not end at its head file,
+// signed by the key of l when set, so that a log truncated or rewritten
+// between two runs is not silently chained again.
+func (l *auditLog) checkHead() error {
+	data, err := readFile(l.path + ".head")
+	if os.IsNotExist(err) {
+		if l.last.Seq == 0 {
+			return nil
+		}
+		return fmt.Errorf("%s: %d entries but no head file", l.path, l.last.Seq)
+	}
+	if err != nil {
+		return err
+	}
+	var head auditHead
+	if err := json.Unmarshal(data, &head); err != nil {
+		return fmt.Errorf("%s.head: %v", l.path, err)
+	}
+	if l.key != nil {
+		if err := verifySig(head.Hash, head.Sig, crypto.PubkeyToAddress(l.key.PublicKey)); err != nil {
+			return fmt.Errorf("%s.head: %v", l.path, err)
+		}
+	}
+	if head.Seq != l.last.Seq || head.Hash != l.last.Hash {
+		return fmt.Errorf("%s: log ends at entry %d %s, head is %d %s: log was truncated or rewritten",
+			l.path, l.last.Seq, l.last.Hash.Hex(), head.Seq, head.Hash.Hex())
+	}
+	l.last.Sig = head.Sig
+	return nil
+}
+
+// audit records action in the audit log if enabled. A failure to record is
+// fatal: no action may go unrecorded.
+func audit(action string, data map[string]string) {
+	if auditor == nil {
+		return
+	}
+	check(auditor.append(action, data))
+}
+
+func (l *auditLog) append(action string, data map[string]string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.lock(); err != nil {
+		return err
+	}
+	defer l.unlock()
+	// Another process may have appended since, chain after its entries.
+	if err := l.catchUp(); err != nil {
+		return err
+	}
+	e := &auditEntry{
+		Seq:    l.last.Seq + 1,
+		Time:   time.Now().UTC(),
+		Action: action,
+		Data:   data,
+		Prev:   l.last.Hash,
+	}
+	var err error
+	if e.Hash, err = e.digest(); err != nil {
+		return err
+	}
+	if l.key != nil {
+		if e.Sig, err = crypto.Sign(e.Hash.Bytes(), l.key); err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if line, err = sealLine(line); err != nil {
+		return err
+	}
+	n, err := l.f.Write(append(line, '\n'))
+	l.off += int64(n)
+	if err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.last = auditHead{Seq: e.Seq, Hash: e.Hash, Sig: e.Sig}
+	return l.writeHead()
+}
+
+// writeHead atomically replaces the head file of the log.
+func (l *auditLog) writeHead() error {
+	data, err := json.Marshal(&l.last)
+	if err != nil {
+		return err
+	}
+	return writeFile(l.path+".head", data)
+}
+
+func (l *auditLog) Close() error {
+	return l.f.Close()
+}
+
+// readAuditLog calls fn with every entry of r after checking it extends the
+// chain of the previous one.
+func readAuditLog(r io.Reader, fn func(*auditEntry) error) error {
+	return readAuditChain(r, auditHead{}, fn)
+}
+
+// readAuditChain is readAuditLog for entries following the entry prev.
+func readAuditChain(r io.Reader, prev auditHead, fn func(*auditEntry) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line, err := openLine(scanner.Bytes())
+		if err != nil {
+			return fmt.Errorf("entry %d: %v", prev.Seq+1, err)
+		}
+		var e auditEntry
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&e); err != nil {
+			return fmt.Errorf("entry %d: %v", prev.Seq+1, err)
+		}
+		if e.Seq != prev.Seq+1 {
+			return fmt.Errorf("entry %d: unexpected sequence number %d", prev.Seq+1, e.Seq)
+		}
+		if e.Prev != prev.Hash {
+			return fmt.Errorf("entry %d: previous hash mismatch", e.Seq)
+		}
+		hash, err := e.digest()
+		if err != nil {
+			return err
+		}
+		if hash != e.Hash {
+			return fmt.Errorf("entry %d: hash mismatch, entry was modified", e.Seq)
+		}
+		if err := fn(&e); err != nil {
+			return err
+		}
+		prev = auditHead{Seq: e.Seq, Hash: e.Hash}
+	}
+	return scanner.Err()
+}
+
+type verifyAuditLogCommand struct {
+	File   string `long:"file" required:"true" description:"Audit log file"`
+	Signer string `long:"signer" description:"Address every entry must be signed by"`
+	Head   string `long:"head" description:"Expected hash of the last entry, defaults to the head file of the log"`
+	MinSeq uint64 `long:"min-seq" description:"Minimum number of entries expected"`
+}
+
+// verifySig checks sig is a signature of hash by signer.
+func verifySig(hash common.Hash, sig []byte, signer common.Address) error {
+	if len(sig) == 0 {
+		return errors.New("missing signature")
+	}
+	pub, err := crypto.SigToPub(hash.Bytes(), sig)
+	if err != nil {
+		return err
+	}
+	if crypto.PubkeyToAddress(*pub) != signer {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+func (c *verifyAuditLogCommand) Execute(args []string) error {
+	var signer *common.Address
+	if c.Signer != "" {
+		addr := common.HexToAddress(c.Signer)
+		signer = &addr
+	}
+
+	f, err := openFile(c.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var last auditHead
+	err = readAuditLog(f, func(e *auditEntry) error {
+		if signer != nil {
+			if err := verifySig(e.Hash, e.Sig, *signer); err != nil {
+				return fmt.Errorf("entry %d: %v", e.Seq, err)
+			}
+		}
+		last = auditHead{Seq: e.Seq, Hash: e.Hash}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v", c.File, err)
+	}
+
+	expected := auditHead{Seq: last.Seq, Hash: common.HexToHash(c.Head)}
+	if c.Head == "" {
+		data, err := readFile(c.File + ".head")
+		if err != nil {
+			return fmt.Errorf("no --head and %v", err)
+		}
+		if err := json.Unmarshal(data, &expected); err != nil {
+			return fmt.Errorf("%s.head: %v", c.File, err)
+		}
+		if signer != nil {
+			if err := verifySig(expected.Hash, expected.Sig, *signer); err != nil {
+				return fmt.Errorf("%s.head: %v", c.File, err)
+			}
+		}
+	}
+	if expected.Seq != last.Seq || expected.Hash != last.Hash {
+		return fmt.Errorf("%s: log ends at entry %d %s, expected %d %s: log was truncated or rewritten",
+			c.File, last.Seq, last.Hash.Hex(), expected.Seq, expected.Hash.Hex())
+	}
+	if last.Seq < c.MinSeq {
+		return fmt.Errorf("%s: %d entries, expected at least %d", c.File, last.Seq, c.MinSeq)
+	}
+	log.Printf("%s: %d entries verified, head %s", c.File, last.Seq, last.Hash.Hex())
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func appendAudit(t *testing.T, l *auditLog, actions ...string) {
+	t.Helper()
+	for _, action := range actions {
+		if err := l.append(action, map[string]string{"value": "1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAuditLogVerify(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := openAuditLog(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAudit(t, l, "plan", "sign", "broadcast")
+	l.Close()
+
+	// A reopened log resumes its chain.
+	if l, err = openAuditLog(path, key); err != nil {
+		t.Fatal(err)
+	}
+	appendAudit(t, l, "confirm")
+	l.Close()
+	if l.last.Seq != 4 {
+		t.Fatalf("last entry %d, want 4", l.last.Seq)
+	}
+
+	signer := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	if err := (&verifyAuditLogCommand{File: path, Signer: signer, MinSeq: 4}).Execute(nil); err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&verifyAuditLogCommand{File: path, Signer: crypto.PubkeyToAddress(other.PublicKey).Hex()}).Execute(nil); err == nil {
+		t.Error("log verified against another signer")
+	}
+}
+
+func TestAuditLogTampered(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := openAuditLog(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAudit(t, l, "plan", "sign", "broadcast")
+	l.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modified := bytes.Replace(data, []byte(`"sign"`), []byte(`"plan"`), 1)
+	if err := os.WriteFile(path, modified, 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = (&verifyAuditLogCommand{File: path}).Execute(nil)
+	if err == nil || !strings.Contains(err.Error(), "hash mismatch") {
+		t.Errorf("modified log: err = %v, want a hash mismatch", err)
+	}
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	truncated := bytes.Join(lines[:2], nil)
+	if err := os.WriteFile(path, truncated, 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = (&verifyAuditLogCommand{File: path}).Execute(nil)
+	if err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("truncated log: err = %v, want a truncation", err)
+	}
+	if _, err := openAuditLog(path, nil); err == nil {
+		t.Error("truncated log resumed")
+	}
+}
+
+// TestAuditLogWriters checks that two writers of a log, as two daemon jobs,
+// extend a single chain.
+func TestAuditLogWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := openAuditLog(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := openAuditLog(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for i := 0; i < 3; i++ {
+		appendAudit(t, a, "sign")
+		appendAudit(t, b, "sign", "broadcast")
+	}
+	if b.last.Seq != 9 {
+		t.Fatalf("last entry %d, want 9", b.last.Seq)
+	}
+	if err := (&verifyAuditLogCommand{File: path, MinSeq: 9}).Execute(nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// sweepIntent is an amount about to be swept, checked by the circuit
+// breaker before anything is broadcast.
+type sweepIntent struct {
+	networkId *big.Int
+	account   common.Address
+	// asset is ETH or the token address.
+	asset    string
+	symbol   string
+	decimals uint
+	amount   *big.Int
+	// fee is the estimated fee in wei, nil if unknown.
+	fee *big.Int
+	// value and feeValue are in the unit of the prices, nil when the
+	// asset or ether can not be priced.
+	value    *big.Rat
+	feeValue *big.Rat
+}
+
+// breakerConfig is the content of the --breaker file. Every threshold is
+// optional.
+type breakerConfig struct {
+	// State is the file the summary of the last run that passed is saved
+	// to.
+	State string `json:"state"`
+	// NotifyURL receives the diff of a tripped run as a JSON POST.
+	NotifyURL     string `json:"notify_url"`
+	MaxAccounts   int    `json:"max_accounts"`
+	MaxTotalValue string `json:"max_total_value"`
+	// MaxFeeRatio is the highest fee to value ratio, in percent.
+	MaxFeeRatio string `json:"max_fee_ratio"`
+	// MaxChange is the highest increase over the previous run of the
+	// number of accounts, the total value and every asset amount, in
+	// percent.
+	MaxChange string `json:"max_change"`
+	// Assets are the highest amounts per asset, ETH, token address or
+	// symbol, optionally prefixed with a network id and a slash.
+	Assets map[string]string `json:"assets"`
+}
+
+// breakerRun is the summary of a run saved to the breaker state.
+type breakerRun struct {
+	Time       time.Time `json:"time"`
+	Accounts   int       `json:"accounts"`
+	TotalValue string    `json:"total_value"`
+	// Assets are the amounts per network id/asset.
+	Assets map[string]string `json:"assets"`
+}
+
+// breaker halts the sweeps looking too different from the previous run or
+// from the configured expectations.
+type breaker struct {
+	breakerConfig
+	mu sync.Mutex
+}
+
+// circuit is the breaker of --breaker, nil when disabled.
+var circuit *breaker
+
+func loadBreaker(path string) (*breaker, error) {
+	data, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b := &breaker{}
+	if err := json.Unmarshal(data, &b.breakerConfig); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if b.State == "" {
+		b.State = path + ".state"
+	}
+	for _, s := range []string{b.MaxFeeRatio, b.MaxChange} {
+		if _, err := parsePercent(s); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return b, nil
+}
+
+// parsePercent parses a percentage such as 50%, returned as a ratio. The
+// empty string is nil.
+func parsePercent(s string) (*big.Rat, error) {
+	if s == "" {
+		return nil, nil
+	}
+	r, ok := new(big.Rat).SetString(strings.TrimSuffix(s, "%"))
+	if !ok || r.Sign() < 0 {
+		return nil, fmt.Errorf("invalid percentage %q", s)
+	}
+	return r.Quo(r, big.NewRat(100, 1)), nil
+}
+
+// summarize returns the summary of intents, and the fee to value ratio of
+// the priced ones.
+func summarize(intents []sweepIntent) (*breakerRun, *big.Rat) {
+	run := &breakerRun{Time: time.Now().UTC(), Assets: make(map[string]string)}
+	accounts := make(map[string]bool)
+	amounts := make(map[string]*big.Rat)
+	total, fees := new(big.Rat), new(big.Rat)
+	for _, in := range intents {
+		accounts[in.networkId.String()+"/"+in.account.Hex()] = true
+		key := in.networkId.String() + "/" + in.asset
+		if amounts[key] == nil {
+			amounts[key] = new(big.Rat)
+		}
+		amounts[key].Add(amounts[key], amountRat(in.amount, in.decimals))
+		if in.value != nil {
+			total.Add(total, in.value)
+		}
+		if in.feeValue != nil {
+			fees.Add(fees, in.feeValue)
+		}
+	}
+	run.Accounts = len(accounts)
+	run.TotalValue = ratString(total)
+	for key, amount := range amounts {
+		run.Assets[key] = ratString(amount)
+	}
+	var ratio *big.Rat
+	if total.Sign() > 0 {
+		ratio = new(big.Rat).Quo(fees, total)
+	}
+	return run, ratio
+}
+
+// increase returns the relative increase from prev to cur, nil when prev
+// is zero.
+func increase(prev, cur *big.Rat) *big.Rat {
+	if prev.Sign() == 0 {
+		return nil
+	}
+	r := new(big.Rat).Sub(cur, prev)
+	return r.Quo(r, prev)
+}
+
+// percent formats a ratio in percent.
+func percent(r *big.Rat) string {
+	return new(big.Rat).Mul(r, big.NewRat(100, 1)).FloatString(1) + "%"
+}
+
+// diff returns the deviations of run from the configuration and from the
+// previous run.
+func (b *breaker) diff(intents []sweepIntent, run *breakerRun, feeRatio *big.Rat, prev *breakerRun) ([]string, error) {
+	var diff []string
+	if b.MaxAccounts > 0 && run.Accounts > b.MaxAccounts {
+		diff = append(diff, fmt.Sprintf("accounts: %d, more than %d", run.Accounts, b.MaxAccounts))
+	}
+	total, _ := new(big.Rat).SetString(run.TotalValue)
+	if b.MaxTotalValue != "" {
+		max, ok := new(big.Rat).SetString(b.MaxTotalValue)
+		if !ok {
+			return nil, fmt.Errorf("invalid max_total_value %q", b.MaxTotalValue)
+		}
+		if total.Cmp(max) > 0 {
+			diff = append(diff, fmt.Sprintf("total value: %s, more than %s", run.TotalValue, b.MaxTotalValue))
+		}
+	}
+	maxFeeRatio, _ := parsePercent(b.MaxFeeRatio)
+	if maxFeeRatio != nil && feeRatio != nil && feeRatio.Cmp(maxFeeRatio) > 0 {
+		diff = append(diff, fmt.Sprintf("fee to value ratio: %s, more than %s", percent(feeRatio), b.MaxFeeRatio))
+	}
+	for _, in := range intents {
+		key := in.networkId.String() + "/" + in.asset
+		var limit string
+		for _, k := range []string{key, in.networkId.String() + "/" + in.symbol, in.asset, in.symbol} {
+			for asset, max := range b.Assets {
+				if strings.EqualFold(asset, k) {
+					limit = max
+				}
+			}
+			if limit != "" {
+				break
+			}
+		}
+		if limit == "" {
+			continue
+		}
+		max, ok := new(big.Rat).SetString(limit)
+		if !ok {
+			return nil, fmt.Errorf("invalid asset limit %q", limit)
+		}
+		amount, _ := new(big.Rat).SetString(run.Assets[key])
+		if amount.Cmp(max) > 0 {
+			line := fmt.Sprintf("%s %s: %s, more than %s", key, in.symbol, run.Assets[key], limit)
+			if !contains(diff, line) {
+				diff = append(diff, line)
+			}
+		}
+	}
+
+	maxChange, _ := parsePercent(b.MaxChange)
+	if maxChange == nil || prev == nil {
+		sort.Strings(diff)
+		return diff, nil
+	}
+	check := func(name, prevValue, curValue string) {
+		p, ok1 := new(big.Rat).SetString(prevValue)
+		c, ok2 := new(big.Rat).SetString(curValue)
+		if !ok1 || !ok2 {
+			return
+		}
+		if inc := increase(p, c); inc != nil && inc.Cmp(maxChange) > 0 {
+			diff = append(diff, fmt.Sprintf("%s: %s -> %s (+%s), more than +%s since %s", name, prevValue, curValue, percent(inc), b.MaxChange, prev.Time.Format(time.RFC3339)))
+		}
+	}
+	check("accounts", fmt.Sprint(prev.Accounts), fmt.Sprint(run.Accounts))
+	check("total value", prev.TotalValue, run.TotalValue)
+	for key, amount := range run.Assets {
+		if prevAmount, ok := prev.Assets[key]; ok {
+			check(key, prevAmount, amount)
+		} else if len(prev.Assets) > 0 {
+			diff = append(diff, fmt.Sprintf("%s: %s, not swept in the previous run", key, amount))
+		}
+	}
+	sort.Strings(diff)
+	return diff, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate compares the sweeps about to be broadcast to the expectations
+// and to the previous run. It returns an error, after notifying the
+// operators, if anything deviates; otherwise the run becomes the new
+// reference.
+func (b *breaker) evaluate(intents []sweepIntent) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var prev *breakerRun
+	if data, err := readFile(b.State); err == nil {
+		prev = &breakerRun{}
+		if err := json.Unmarshal(data, prev); err != nil {
+			return fmt.Errorf("%s: %v", b.State, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	run, feeRatio := summarize(intents)
+	diff, err := b.diff(intents, run, feeRatio, prev)
+	if err != nil {
+		return err
+	}
+	if len(diff) == 0 {
+		data, err := json.MarshalIndent(run, "", "  ")
+		if err != nil {
+			return err
+		}
+		return writeFile(b.State, data)
+	}
+
+	for _, line := range diff {
+		log.Printf("Circuit breaker: %s", line)
+	}
+	audit("breaker", map[string]string{"state": "tripped", "diff": strings.Join(diff, "; ")})
+	if b.NotifyURL != "" {
+		data, err := json.Marshal(map[string]interface{}{"diff": diff, "run": run, "previous": prev})
+		if err != nil {
+			return err
+		}
+		resp, err := http.Post(b.NotifyURL, "application/json", bytes.NewReader(data))
+		if err != nil {
+			log.Printf("Circuit breaker notification: %v", err)
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				log.Printf("Circuit breaker notification: %s", resp.Status)
+			}
+		}
+	}
+	return fmt.Errorf("circuit breaker tripped, nothing swept:\n  %s", strings.Join(diff, "\n  "))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var breakerToken = common.HexToAddress("0x10")
+
+// tokenIntent is a sweep of amount whole units of a 6 decimals token worth
+// one each, with a fee worth 1.
+func tokenIntent(account byte, amount int64) sweepIntent {
+	return sweepIntent{
+		networkId: big.NewInt(1),
+		account:   common.Address{account},
+		asset:     breakerToken.Hex(),
+		symbol:    "USDC",
+		decimals:  6,
+		amount:    new(big.Int).Mul(big.NewInt(amount), big.NewInt(1000000)),
+		value:     big.NewRat(amount, 1),
+		feeValue:  big.NewRat(1, 1),
+	}
+}
+
+// writeBreaker writes a --breaker file of config and loads it.
+func writeBreaker(t *testing.T, config breakerConfig) *breaker {
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "breaker.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := loadBreaker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBreakerLimits(t *testing.T) {
+	notified := make(chan []string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		var body struct{ Diff []string }
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Error(err)
+		}
+		notified <- body.Diff
+	}))
+	defer server.Close()
+	b := writeBreaker(t, breakerConfig{
+		NotifyURL:     server.URL,
+		MaxAccounts:   2,
+		MaxTotalValue: "100",
+		MaxFeeRatio:   "5%",
+		Assets:        map[string]string{"usdc": "60"},
+	})
+
+	if err := b.evaluate([]sweepIntent{tokenIntent(1, 30), tokenIntent(2, 30)}); err != nil {
+		t.Fatalf("run within limits: %v", err)
+	}
+	if _, err := os.Stat(b.State); err != nil {
+		t.Fatalf("state of a passed run: %v", err)
+	}
+
+	err := b.evaluate([]sweepIntent{tokenIntent(1, 60), tokenIntent(2, 40), tokenIntent(3, 1)})
+	want := []string{
+		"1/" + breakerToken.Hex() + " USDC: 101, more than 60",
+		"accounts: 3, more than 2",
+		"total value: 101, more than 100",
+	}
+	if err == nil {
+		t.Fatal("breaker not tripped")
+	}
+	if got := <-notified; !reflect.DeepEqual(got, want) {
+		t.Errorf("notified %q, want %q", got, want)
+	}
+
+	// Fees of a fifth of the value.
+	err = b.evaluate([]sweepIntent{tokenIntent(1, 5)})
+	if err == nil || !strings.Contains(err.Error(), "fee to value ratio: 20.0%, more than 5%") {
+		t.Errorf("expensive run: %v", err)
+	}
+	<-notified
+}
+
+func TestBreakerChange(t *testing.T) {
+	b := writeBreaker(t, breakerConfig{MaxChange: "50%"})
+	if err := b.evaluate([]sweepIntent{tokenIntent(1, 10), tokenIntent(2, 10)}); err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+	// Within 50% of the first run, which it replaces.
+	if err := b.evaluate([]sweepIntent{tokenIntent(1, 15), tokenIntent(2, 10)}); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	err := b.evaluate([]sweepIntent{tokenIntent(1, 25), tokenIntent(2, 25)})
+	if err == nil || !strings.Contains(err.Error(), "total value: 25 -> 50 (+100.0%), more than +50%") {
+		t.Errorf("doubled run: %v", err)
+	}
+	// A tripped run does not become the reference.
+	if err := b.evaluate([]sweepIntent{tokenIntent(1, 15), tokenIntent(2, 10)}); err != nil {
+		t.Errorf("run as the last passed one: %v", err)
+	}
+
+	ether := sweepIntent{networkId: big.NewInt(1), account: common.Address{1}, asset: "ETH", symbol: "ETH", decimals: 18, amount: big.NewInt(1)}
+	err = b.evaluate([]sweepIntent{tokenIntent(1, 15), tokenIntent(2, 10), ether})
+	if err == nil || !strings.Contains(err.Error(), "1/ETH: 0.000000000000000001, not swept in the previous run") {
+		t.Errorf("run of a new asset: %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+type callCommand struct {
+	ABI       string   `long:"abi" description:"JSON ABI file of the contract, with --method"`
+	Method    string   `long:"method" description:"Method of the --abi to call"`
+	Signature string   `long:"signature" description:"Human-readable signature of the method, e.g. 'earned(address) returns (uint256)'"`
+	Contract  string   `long:"contract" required:"true" description:"Address of the called contract"`
+	Args      []string `long:"arg" description:"Arguments of the call, {account} is replaced with the address of each account"`
+}
+
+// parseSignature returns the ABI of a human-readable method signature such
+// as "function balanceOf(address owner) view returns (uint256)".
+func parseSignature(sig string) (abi.ABI, string, error) {
+	sig = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(sig), "function "))
+	open := strings.Index(sig, "(")
+	if open <= 0 {
+		return abi.ABI{}, "", fmt.Errorf("invalid signature %q", sig)
+	}
+	name := strings.TrimSpace(sig[:open])
+	inputs, rest, err := parseParams(sig[open:])
+	if err != nil {
+		return abi.ABI{}, "", fmt.Errorf("invalid signature %q: %v", sig, err)
+	}
+	var outputs []abi.ArgumentMarshaling
+	rest = strings.TrimSpace(rest)
+	for _, modifier := range []string{"external", "public", "view", "pure"} {
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, modifier))
+	}
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, "returns"))
+	if rest != "" {
+		if outputs, rest, err = parseParams(rest); err != nil || strings.TrimSpace(rest) != "" {
+			return abi.ABI{}, "", fmt.Errorf("invalid signature %q: bad return types", sig)
+		}
+	}
+	data, err := json.Marshal([]map[string]interface{}{{
+		"type":            "function",
+		"name":            name,
+		"inputs":          inputs,
+		"outputs":         outputs,
+		"stateMutability": "view",
+	}})
+	if err != nil {
+		return abi.ABI{}, "", err
+	}
+	parsed, err := abi.JSON(bytes.NewReader(data))
+	return parsed, name, err
+}
+
+// parseParams parses a parenthesized list of "type [name]" and returns it
+// with the text following it.
+func parseParams(s string) ([]abi.ArgumentMarshaling, string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "(") {
+		return nil, s, fmt.Errorf("expected (")
+	}
+	end := strings.Index(s, ")")
+	if end < 0 {
+		return nil, s, fmt.Errorf("expected )")
+	}
+	if strings.Contains(s[1:end], "(") {
+		return nil, s, fmt.Errorf("tuples are not supported, use --abi")
+	}
+	params := []abi.ArgumentMarshaling{}
+	if list := strings.TrimSpace(s[1:end]); list != "" {
+		for i, param := range strings.Split(list, ",") {
+			fields := strings.Fields(param)
+			if len(fields) == 0 {
+				return nil, s, fmt.Errorf("empty parameter %d", i)
+			}
+			p := abi.ArgumentMarshaling{Type: fields[0]}
+			if n := len(fields); n > 1 && fields[n-1] != "memory" && fields[n-1] != "calldata" {
+				p.Name = fields[n-1]
+			}
+			params = append(params, p)
+		}
+	}
+	return params, s[end+1:], nil
+}
+
+// parseArg converts s to the Go value of the ABI type t. Arrays are
+// written [a,b,c].
+func parseArg(t abi.Type, s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	switch t.T {
+	case abi.AddressTy:
+		if !common.IsHexAddress(s) {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		return common.HexToAddress(s), nil
+	case abi.BoolTy:
+		return strconv.ParseBool(s)
+	case abi.StringTy:
+		return s, nil
+	case abi.BytesTy:
+		return hexutil.Decode(s)
+	case abi.FixedBytesTy:
+		b, err := hexutil.Decode(s)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > t.Size {
+			return nil, fmt.Errorf("%q is longer than %s", s, t)
+		}
+		v := reflect.New(t.GetType()).Elem()
+		reflect.Copy(v, reflect.ValueOf(b))
+		return v.Interface(), nil
+	case abi.IntTy, abi.UintTy:
+		n, ok := new(big.Int).SetString(s, 0)
+		if !ok || t.T == abi.UintTy && n.Sign() < 0 {
+			return nil, fmt.Errorf("invalid %s %q", t, s)
+		}
+		if t.Size > 64 {
+			return n, nil
+		}
+		v := reflect.New(t.GetType()).Elem()
+		if t.T == abi.IntTy {
+			if !n.IsInt64() || v.OverflowInt(n.Int64()) {
+				return nil, fmt.Errorf("%q overflows %s", s, t)
+			}
+			v.SetInt(n.Int64())
+		} else {
+			if !n.IsUint64() || v.OverflowUint(n.Uint64()) {
+				return nil, fmt.Errorf("%q overflows %s", s, t)
+			}
+			v.SetUint(n.Uint64())
+		}
+		return v.Interface(), nil
+	case abi.SliceTy, abi.ArrayTy:
+		if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("expected [...] for %s", t)
+		}
+		var elems []string
+		if inner := strings.TrimSpace(s[1 : len(s)-1]); inner != "" {
+			elems = strings.Split(inner, ",")
+		}
+		if t.T == abi.ArrayTy && len(elems) != t.Size {
+			return nil, fmt.Errorf("%s needs %d elements", t, t.Size)
+		}
+		v := reflect.MakeSlice(reflect.SliceOf(t.GetType().Elem()), len(elems), len(elems))
+		if t.T == abi.ArrayTy {
+			v = reflect.New(t.GetType()).Elem()
+		}
+		for i, elem := range elems {
+			e, err := parseArg(*t.Elem, elem)
+			if err != nil {
+				return nil, err
+			}
+			v.Index(i).Set(reflect.ValueOf(e))
+		}
+		return v.Interface(), nil
+	}
+	return nil, fmt.Errorf("unsupported argument type %s", t)
+}
+
+// formatResult formats a value unpacked from a call result.
+func formatResult(v interface{}) string {
+	switch v := v.(type) {
+	case *big.Int:
+		return v.String()
+	case common.Address:
+		return v.Hex()
+	case []byte:
+		return hexutil.Encode(v)
+	case string:
+		return strconv.Quote(v)
+	}
+	rv := reflect.ValueOf(v)
+	switch {
+	case rv.Kind() == reflect.Array && rv.Type().Elem().Kind() == reflect.Uint8:
+		b := make([]byte, rv.Len())
+		reflect.Copy(reflect.ValueOf(b), rv)
+		return hexutil.Encode(b)
+	case rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array:
+		var elems []string
+		for i := 0; i < rv.Len(); i++ {
+			elems = append(elems, formatResult(rv.Index(i).Interface()))
+		}
+		return "[" + strings.Join(elems, ",") + "]"
+	}
+	return fmt.Sprint(v)
+}
+
+func (c *callCommand) Execute(args []string) error {
+	var parsed abi.ABI
+	method := c.Method
+	var err error
+	switch {
+	case c.Signature != "":
+		if parsed, method, err = parseSignature(c.Signature); err != nil {
+			return err
+		}
+	case c.ABI != "":
+		data, err := readFile(c.ABI)
+		if err != nil {
+			return err
+		}
+		if parsed, err = abi.JSON(bytes.NewReader(data)); err != nil {
+			return fmt.Errorf("%s: %v", c.ABI, err)
+		}
+	default:
+		return fmt.Errorf("no method, use --signature or --abi with --method")
+	}
+	m, ok := parsed.Methods[method]
+	if !ok {
+		return fmt.Errorf("no method %q in the ABI", method)
+	}
+	if len(c.Args) != len(m.Inputs) {
+		return fmt.Errorf("%s takes %d arguments, %d given", method, len(m.Inputs), len(c.Args))
+	}
+	if !common.IsHexAddress(c.Contract) {
+		return fmt.Errorf("invalid contract address %q", c.Contract)
+	}
+	contract := common.HexToAddress(c.Contract)
+
+	w, err := newResultWriter(opts.Output)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	s, err := newScanner(ctx, w)
+	if err != nil {
+		return err
+	}
+	s.visit = func(ctx context.Context, ch *chain, acc account, w io.Writer) {
+		values := make([]interface{}, len(m.Inputs))
+		for i, arg := range c.Args {
+			v, err := parseArg(m.Inputs[i].Type, strings.Replace(arg, "{account}", acc.address.Hex(), -1))
+			if err != nil {
+				fmt.Fprintf(w, "%s [network id: %s], %s: error: argument %d: %v\n", acc.address.Hex(), ch.networkId, method, i, err)
+				return
+			}
+			values[i] = v
+		}
+		input, err := parsed.Pack(method, values...)
+		if err != nil {
+			fmt.Fprintf(w, "%s [network id: %s], %s: error: %v\n", acc.address.Hex(), ch.networkId, method, err)
+			return
+		}
+		output, err := ch.client.CallContract(ctx, ethereum.CallMsg{From: acc.address, To: &contract, Data: input}, nil)
+		if err != nil {
+			fmt.Fprintf(w, "%s [network id: %s], %s: error: %v\n", acc.address.Hex(), ch.networkId, method, redactError(err, ch.url))
+			return
+		}
+		results, err := m.Outputs.UnpackValues(output)
+		if err != nil {
+			fmt.Fprintf(w, "%s [network id: %s], %s: error: %v\n", acc.address.Hex(), ch.networkId, method, err)
+			return
+		}
+		var fields []string
+		for i, v := range results {
+			field := formatResult(v)
+			if name := m.Outputs[i].Name; name != "" {
+				field = name + "=" + field
+			}
+			fields = append(fields, field)
+		}
+		fmt.Fprintf(w, "%s [network id: %s], %s: %s\n", acc.address.Hex(), ch.networkId, method, strings.Join(fields, ", "))
+	}
+	return s.run(ctx)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// checkFailed is the exit status of the check command when a rule fails,
+// checkError when none fails but a rule could not be evaluated.
+const (
+	checkFailed = 3
+	checkError  = 4
+)
+
+// rule is a balance assertion, see the check command.
+type rule struct {
+	Name string `json:"name"`
+	// Group is the name of the group of accounts checked, all the scanned
+	// accounts when empty or "*".
+	Group string `json:"group"`
+	// Asset is ETH, a token symbol or a token contract address.
+	Asset string `json:"asset"`
+	// NetworkId restricts the rule to one network.
+	NetworkId string `json:"network_id"`
+	// Each checks every account of the group instead of their total.
+	Each bool `json:"each"`
+	// Op is one of >=, >, <=, <, ==, != or within.
+	Op    string `json:"op"`
+	Value string `json:"value"`
+	// Tolerance of the within operator, in percent of the value.
+	Tolerance string `json:"tolerance"`
+	// Reference is a JSON file of asset to amount used as value.
+	Reference string `json:"reference"`
+}
+
+// scanResults holds, by network id, the accounts scanned and the error
+// reading their balances, nil when every balance was read.
+type scanResults map[string]map[common.Address]error
+
+// rulesFile is the content of a --rules file.
+type rulesFile struct {
+	Groups map[string][]common.Address `json:"groups"`
+	Rules  []rule                      `json:"rules"`
+}
+
+type checkCommand struct {
+	Rules string `long:"rules" required:"true" description:"JSON rules file"`
+}
+
+func (c *checkCommand) Execute(args []string) error {
+	data, err := readFile(c.Rules)
+	if err != nil {
+		return err
+	}
+	var rules rulesFile
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return fmt.Errorf("%s: %v", c.Rules, err)
+	}
+
+	var balances []balance
+	s, err := newScanner(ctx, ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	s.onBalance = func(b balance) {
+		balances = append(balances, b)
+	}
+	scans := make(scanResults)
+	for _, ch := range s.chains {
+		scans[ch.networkId.String()] = make(map[common.Address]error)
+	}
+	s.onAccount = func(ch *chain, addr common.Address, err error) {
+		accounts := scans[ch.networkId.String()]
+		if _, ok := accounts[addr]; !ok || err != nil {
+			accounts[addr] = err
+		}
+	}
+	if err := s.run(ctx); err != nil {
+		return err
+	}
+	// The balances of a network that could not be reached are unknown.
+	var dialErr error
+	if n := len(opts.RPCURLs) - len(s.chains); n > 0 {
+		dialErr = fmt.Errorf("%d of %d rpc urls could not be reached", n, len(opts.RPCURLs))
+	}
+
+	failed, errored := 0, 0
+	for _, r := range rules.Rules {
+		ok, detail, err := r.eval(rules.Groups, balances, scans)
+		if dialErr != nil {
+			err = dialErr
+		}
+		switch {
+		case err != nil:
+			errored++
+			fmt.Printf("ERROR %s: %v\n", r.Name, err)
+		case ok:
+			fmt.Printf("PASS %s: %s\n", r.Name, detail)
+		default:
+			failed++
+			fmt.Printf("FAIL %s: %s\n", r.Name, detail)
+		}
+	}
+	if errored > 0 {
+		fmt.Printf("%d/%d rules could not be evaluated\n", errored, len(rules.Rules))
+	}
+	if failed > 0 {
+		return &exitError{status: checkFailed, err: fmt.Errorf("%d/%d rules failed", failed, len(rules.Rules))}
+	}
+	if errored > 0 {
+		return &exitError{status: checkError, err: fmt.Errorf("%d/%d rules could not be evaluated", errored, len(rules.Rules))}
+	}
+	return nil
+}
+
+// matches reports whether b is a balance of the asset of r.
+func (r *rule) matches(b balance) bool {
+	if r.NetworkId != "" && b.networkId.String() != r.NetworkId {
+		return false
+	}
+	if b.token == nil {
+		return strings.EqualFold(r.Asset, "ETH")
+	}
+	if common.IsHexAddress(r.Asset) {
+		return common.HexToAddress(r.Asset) == *b.token
+	}
+	return strings.EqualFold(r.Asset, b.info.symbol)
+}
+
+// expected returns the value r compares balances to.
+func (r *rule) expected() (*big.Rat, error) {
+	value := r.Value
+	if r.Reference != "" {
+		data, err := readFile(r.Reference)
+		if err != nil {
+			return nil, err
+		}
+		var ref map[string]string
+		if err := json.Unmarshal(data, &ref); err != nil {
+			return nil, fmt.Errorf("%s: %v", r.Reference, err)
+		}
+		var ok bool
+		if value, ok = ref[r.Asset]; !ok {
+			return nil, fmt.Errorf("%s: no value for %s", r.Reference, r.Asset)
+		}
+	}
+	v, ok := new(big.Rat).SetString(value)
+	if !ok {
+		return nil, fmt.Errorf("invalid value %q", value)
+	}
+	return v, nil
+}
+
+// compare applies the operator of r to actual and expected.
+func (r *rule) compare(actual, expected *big.Rat) (bool, error) {
+	c := actual.Cmp(expected)
+	switch r.Op {
+	case ">=":
+		return c >= 0, nil
+	case ">":
+		return c > 0, nil
+	case "<=":
+		return c <= 0, nil
+	case "<":
+		return c < 0, nil
+	case "==":
+		return c == 0, nil
+	case "!=":
+		return c != 0, nil
+	case "within":
+		tolerance, ok := new(big.Rat).SetString(strings.TrimSuffix(r.Tolerance, "%"))
+		if !ok {
+			return false, fmt.Errorf("invalid tolerance %q", r.Tolerance)
+		}
+		diff := new(big.Rat).Sub(actual, expected)
+		diff.Abs(diff)
+		limit := new(big.Rat).Mul(new(big.Rat).Abs(expected), tolerance)
+		limit.Quo(limit, big.NewRat(100, 1))
+		return diff.Cmp(limit) <= 0, nil
+	}
+	return false, fmt.Errorf("unknown operator %q", r.Op)
+}
+
+// eval evaluates r against balances. An account of the group that was not
+// scanned, or whose balances could not all be read, makes it an error.
+func (r *rule) eval(groups map[string][]common.Address, balances []balance, scans scanResults) (bool, string, error) {
+	expected, err := r.expected()
+	if err != nil {
+		return false, "", err
+	}
+	var members map[common.Address]bool
+	if r.Group != "" && r.Group != "*" {
+		group, ok := groups[r.Group]
+		if !ok {
+			return false, "", fmt.Errorf("unknown group %q", r.Group)
+		}
+		members = make(map[common.Address]bool)
+		for _, addr := range group {
+			members[addr] = true
+		}
+	}
+
+	networks := 0
+	for networkId, accounts := range scans {
+		if r.NetworkId != "" && networkId != r.NetworkId {
+			continue
+		}
+		networks++
+		for addr, err := range accounts {
+			if err != nil && (members == nil || members[addr]) {
+				return false, "", fmt.Errorf("%s on network %s: %v", addr.Hex(), networkId, err)
+			}
+		}
+		for addr := range members {
+			if _, ok := accounts[addr]; !ok {
+				return false, "", fmt.Errorf("%s was not scanned on network %s", addr.Hex(), networkId)
+			}
+		}
+	}
+	if networks == 0 {
+		if r.NetworkId != "" {
+			return false, "", fmt.Errorf("network %s was not scanned", r.NetworkId)
+		}
+		return false, "", fmt.Errorf("no network was scanned")
+	}
+
+	totals := make(map[common.Address]*big.Rat)
+	for addr := range members {
+		totals[addr] = new(big.Rat)
+	}
+	for _, b := range balances {
+		if members != nil && !members[b.account] || !r.matches(b) {
+			continue
+		}
+		if totals[b.account] == nil {
+			totals[b.account] = new(big.Rat)
+		}
+		totals[b.account].Add(totals[b.account], amountRat(b.amount, b.info.decimals))
+	}
+
+	if !r.Each {
+		total := new(big.Rat)
+		for _, v := range totals {
+			total.Add(total, v)
+		}
+		ok, err := r.compare(total, expected)
+		return ok, fmt.Sprintf("%s %s %s %s", ratString(total), r.Asset, r.Op, ratString(expected)), err
+	}
+	var bad []string
+	for addr, v := range totals {
+		ok, err := r.compare(v, expected)
+		if err != nil {
+			return false, "", err
+		}
+		if !ok {
+			bad = append(bad, fmt.Sprintf("%s has %s %s", addr.Hex(), ratString(v), r.Asset))
+		}
+	}
+	if len(bad) > 0 {
+		return false, fmt.Sprintf("not %s %s: %s", r.Op, ratString(expected), strings.Join(bad, ", ")), nil
+	}
+	return true, fmt.Sprintf("%d accounts %s %s %s", len(totals), r.Asset, r.Op, ratString(expected)), nil
+}
+
+// amountRat returns amount in units of 10^decimals.
+func amountRat(amount *big.Int, decimals uint) *big.Rat {
+	return new(big.Rat).SetFrac(amount, new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil))
+}
+
+// ratString formats r as a decimal without trailing zeros.
+func ratString(r *big.Rat) string {
+	str := r.FloatString(18)
+	str = strings.TrimRight(str, "0")
+	return strings.TrimSuffix(str, ".")
+}
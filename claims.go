@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// MerkleDistributorABI is the ABI of MerkleDistributor of claims.sol.
+const MerkleDistributorABI = `[{"inputs":[],"name":"token","outputs":[{"name":"","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[{"name":"index","type":"uint256"}],"name":"isClaimed","outputs":[{"name":"","type":"bool"}],"stateMutability":"view","type":"function"},{"inputs":[{"name":"index","type":"uint256"},{"name":"account","type":"address"},{"name":"amount","type":"uint256"},{"name":"merkleProof","type":"bytes32[]"}],"name":"claim","outputs":[],"stateMutability":"nonpayable","type":"function"}]`
+
+// VestingWalletABI is the ABI of VestingWallet of claims.sol. The ether
+// overloads come first and keep the plain names, the token ones are
+// releasable0 and release0.
+const VestingWalletABI = `[{"inputs":[],"name":"beneficiary","outputs":[{"name":"","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"owner","outputs":[{"name":"","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"releasable","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"},{"inputs":[{"name":"token","type":"address"}],"name":"releasable","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"release","outputs":[],"stateMutability":"nonpayable","type":"function"},{"inputs":[{"name":"token","type":"address"}],"name":"release","outputs":[],"stateMutability":"nonpayable","type":"function"}]`
+
+// StakingRewardsABI is the ABI of StakingRewards of claims.sol.
+const StakingRewardsABI = `[{"inputs":[],"name":"rewardsToken","outputs":[{"name":"","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[{"name":"account","type":"address"}],"name":"earned","outputs":[{"name":"","type":"uint256"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"getReward","outputs":[],"stateMutability":"nonpayable","type":"function"}]`
+
+// claim is an amount an account can claim, of ether when token is nil.
+type claim struct {
+	source string
+	token  *common.Address
+	amount *big.Int
+	// args are the arguments of the claiming call.
+	args []interface{}
+}
+
+// Claimer finds and claims the funds of a kind of contract.
+type Claimer interface {
+	// Claimable returns what acc can claim on ch.
+	Claimable(ctx context.Context, ch *chain, acc account) ([]claim, error)
+	// Claim sends the transaction of acc claiming c.
+	Claim(ctx context.Context, ch *chain, acc account, c claim) (*types.Transaction, error)
+}
+
+// claimers are the claimers of --claims.
+var claimers []Claimer
+
+// claimTimeout is how long a claim is waited for before its account is
+// scanned without it.
+var claimTimeout = 10 * time.Minute
+
+// claimsConfig is the --claims file.
+type claimsConfig struct {
+	Merkle []struct {
+		NetworkId   string         `json:"network_id"`
+		Distributor common.Address `json:"distributor"`
+		// Proofs is the JSON file of the Merkle proofs, in the format of
+		// the Uniswap distributor.
+		Proofs string `json:"proofs"`
+	} `json:"merkle"`
+	Vesting []struct {
+		NetworkId string         `json:"network_id"`
+		Wallet    common.Address `json:"wallet"`
+		// Assets are ETH or token addresses.
+		Assets []string `json:"assets"`
+	} `json:"vesting"`
+	Staking []struct {
+		NetworkId string         `json:"network_id"`
+		Contract  common.Address `json:"contract"`
+	} `json:"staking"`
+}
+
+// loadClaimers reads the claims configuration at path.
+func loadClaimers(path string) ([]Claimer, error) {
+	data, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config claimsConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var list []Claimer
+	for _, m := range config.Merkle {
+		c, err := newMerkleClaimer(m.NetworkId, m.Distributor, m.Proofs)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	for _, v := range config.Vesting {
+		c := &vestingClaimer{networkId: v.NetworkId, wallet: v.Wallet}
+		for _, asset := range v.Assets {
+			if strings.EqualFold(asset, "ETH") {
+				c.tokens = append(c.tokens, nil)
+				continue
+			}
+			if !common.IsHexAddress(asset) {
+				return nil, fmt.Errorf("%s: invalid vesting asset %q", path, asset)
+			}
+			token := common.HexToAddress(asset)
+			c.tokens = append(c.tokens, &token)
+		}
+		list = append(list, c)
+	}
+	for _, s := range config.Staking {
+		list = append(list, &stakingClaimer{networkId: s.NetworkId, contract: s.Contract})
+	}
+	return list, nil
+}
+
+// onNetwork tells whether a claimer configured for networkId, any network
+// when empty, applies to ch.
+func onNetwork(networkId string, ch *chain) bool {
+	return networkId == "" || networkId == ch.networkId.String()
+}
+
+// boundContract binds the contract at addr with the ABI definition.
+func boundContract(ch *chain, addr common.Address, definition string) (*bind.BoundContract, error) {
+	parsed, err := abi.JSON(strings.NewReader(definition))
+	if err != nil {
+		return nil, err
+	}
+	return bind.NewBoundContract(addr, parsed, ch.client, ch.client, ch.client), nil
+}
+
+// transactor returns the transact options of acc.
+func transactor(ctx context.Context, acc account) *bind.TransactOpts {
+	auth := bind.NewKeyedTransactor(acc.key)
+	auth.Context = ctx
+	return auth
+}
+
+// merkleProof is an entry of a Merkle proofs file.
+type merkleProof struct {
+	Index  uint64        `json:"index"`
+	Amount string        `json:"amount"`
+	Proof  []common.Hash `json:"proof"`
+}
+
+// merkleClaimer claims airdrops of a Merkle distributor.
+type merkleClaimer struct {
+	networkId   string
+	distributor common.Address
+	proofs      map[common.Address]merkleProof
+}
+
+func newMerkleClaimer(networkId string, distributor common.Address, path string) (*merkleClaimer, error) {
+	data, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Claims map[string]merkleProof `json:"claims"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	c := &merkleClaimer{networkId: networkId, distributor: distributor, proofs: make(map[common.Address]merkleProof)}
+	for addr, proof := range file.Claims {
+		if !common.IsHexAddress(addr) {
+			return nil, fmt.Errorf("%s: invalid address %q", path, addr)
+		}
+		if _, ok := new(big.Int).SetString(proof.Amount, 0); !ok {
+			return nil, fmt.Errorf("%s: invalid amount %q of %s", path, proof.Amount, addr)
+		}
+		c.proofs[common.HexToAddress(addr)] = proof
+	}
+	return c, nil
+}
+
+func (c *merkleClaimer) Claimable(ctx context.Context, ch *chain, acc account) ([]claim, error) {
+	proof, ok := c.proofs[acc.address]
+	if !ok || !onNetwork(c.networkId, ch) {
+		return nil, nil
+	}
+	distributor, err := boundContract(ch, c.distributor, MerkleDistributorABI)
+	if err != nil {
+		return nil, err
+	}
+	callOpts := &bind.CallOpts{Context: ctx}
+	index := new(big.Int).SetUint64(proof.Index)
+	var claimed bool
+	if err := distributor.Call(callOpts, &claimed, "isClaimed", index); err != nil {
+		return nil, err
+	}
+	if claimed {
+		return nil, nil
+	}
+	var token common.Address
+	if err := distributor.Call(callOpts, &token, "token"); err != nil {
+		return nil, err
+	}
+	amount, _ := new(big.Int).SetString(proof.Amount, 0)
+	// claim takes the proof as bytes32[].
+	leaves := make([][32]byte, len(proof.Proof))
+	for i, h := range proof.Proof {
+		leaves[i] = h
+	}
+	return []claim{{
+		source: "merkle distributor " + c.distributor.Hex(),
+		token:  &token,
+		amount: amount,
+		args:   []interface{}{index, acc.address, amount, leaves},
+	}}, nil
+}
+
+func (c *merkleClaimer) Claim(ctx context.Context, ch *chain, acc account, cl claim) (*types.Transaction, error) {
+	distributor, err := boundContract(ch, c.distributor, MerkleDistributorABI)
+	if err != nil {
+		return nil, err
+	}
+	return distributor.Transact(transactor(ctx, acc), "claim", cl.args...)
+}
+
+// vestingClaimer releases the vested assets of a vesting wallet whose
+// beneficiary is the account.
+type vestingClaimer struct {
+	networkId string
+	wallet    common.Address
+	// tokens are the released assets, nil for ether.
+	tokens []*common.Address
+}
+
+func (c *vestingClaimer) Claimable(ctx context.Context, ch *chain, acc account) ([]claim, error) {
+	if !onNetwork(c.networkId, ch) {
+		return nil, nil
+	}
+	wallet, err := boundContract(ch, c.wallet, VestingWalletABI)
+	if err != nil {
+		return nil, err
+	}
+	callOpts := &bind.CallOpts{Context: ctx}
+	var beneficiary common.Address
+	if err := wallet.Call(callOpts, &beneficiary, "owner"); err != nil {
+		if err := wallet.Call(callOpts, &beneficiary, "beneficiary"); err != nil {
+			return nil, err
+		}
+	}
+	if beneficiary != acc.address {
+		return nil, nil
+	}
+	var claims []claim
+	for _, token := range c.tokens {
+		var amount *big.Int
+		if token == nil {
+			err = wallet.Call(callOpts, &amount, "releasable")
+		} else {
+			err = wallet.Call(callOpts, &amount, "releasable0", *token)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if amount.Sign() == 0 {
+			continue
+		}
+		claims = append(claims, claim{source: "vesting wallet " + c.wallet.Hex(), token: token, amount: amount})
+	}
+	return claims, nil
+}
+
+func (c *vestingClaimer) Claim(ctx context.Context, ch *chain, acc account, cl claim) (*types.Transaction, error) {
+	wallet, err := boundContract(ch, c.wallet, VestingWalletABI)
+	if err != nil {
+		return nil, err
+	}
+	if cl.token == nil {
+		return wallet.Transact(transactor(ctx, acc), "release")
+	}
+	return wallet.Transact(transactor(ctx, acc), "release0", *cl.token)
+}
+
+// stakingClaimer collects the rewards earned by the account on a staking
+// rewards contract.
+type stakingClaimer struct {
+	networkId string
+	contract  common.Address
+}
+
+func (c *stakingClaimer) Claimable(ctx context.Context, ch *chain, acc account) ([]claim, error) {
+	if !onNetwork(c.networkId, ch) {
+		return nil, nil
+	}
+	staking, err := boundContract(ch, c.contract, StakingRewardsABI)
+	if err != nil {
+		return nil, err
+	}
+	callOpts := &bind.CallOpts{Context: ctx}
+	var earned *big.Int
+	if err := staking.Call(callOpts, &earned, "earned", acc.address); err != nil {
+		return nil, err
+	}
+	if earned.Sign() == 0 {
+		return nil, nil
+	}
+	var token common.Address
+	if err := staking.Call(callOpts, &token, "rewardsToken"); err != nil {
+		return nil, err
+	}
+	return []claim{{source: "staking rewards " + c.contract.Hex(), token: &token, amount: earned}}, nil
+}
+
+func (c *stakingClaimer) Claim(ctx context.Context, ch *chain, acc account, cl claim) (*types.Transaction, error) {
+	staking, err := boundContract(ch, c.contract, StakingRewardsABI)
+	if err != nil {
+		return nil, err
+	}
+	return staking.Transact(transactor(ctx, acc), "getReward")
+}
+
+// claimAll prints what acc can claim on ch to w and, when send is set,
+// claims it and waits for the claims to be mined so that the sweep that
+// follows moves the claimed funds. The claims are held with the sweeps
+// when the circuit breaker is enabled, their funds are then swept by the
+// next run.
+func (s *scanner) claimAll(ctx context.Context, ch *chain, acc account, w io.Writer, send bool) {
+	for _, claimer := range claimers {
+		claims, err := claimer.Claimable(ctx, ch, acc)
+		if err != nil {
+			fmt.Fprintf(w, "%s: claimable: error: %v\n", acc.address.Hex(), redactError(err, ch.url))
+			continue
+		}
+		for _, cl := range claims {
+			claimer, cl := claimer, cl
+			unit, dec := "ETH", uint(18)
+			if cl.token != nil {
+				erc20, err := NewERC20Caller(*cl.token, ch.client)
+				check(err)
+				info := ch.tokenInfo(*cl.token, erc20)
+				unit, dec = info.symbol, info.decimals
+			}
+			fmt.Fprintf(w, "%s, claimable: %s %s [%s]\n", acc.address.Hex(), formatUnits(cl.amount, dec), unit, cl.source)
+			if !send {
+				continue
+			}
+			// Held claims run after w is written out.
+			out := w
+			if circuit != nil {
+				out = s.w
+			}
+			s.sweep([]sweepIntent{s.intent(ch, acc.address, cl.token, cl.amount, nil)}, func() {
+				claimOne(ctx, ch, acc, claimer, cl, unit, dec, out)
+			})
+		}
+	}
+}
+
+// claimOne sends the claim cl of acc and waits for it to be mined.
+func claimOne(ctx context.Context, ch *chain, acc account, claimer Claimer, cl claim, unit string, dec uint, w io.Writer) {
+	if err := halted(); err != nil {
+		fmt.Fprintf(w, "%s: not claimed: %v\n", acc.address.Hex(), err)
+		return
+	}
+	data := map[string]string{"network_id": ch.networkId.String(), "from": acc.address.Hex(), "source": cl.source, "amount": cl.amount.String()}
+	tx, err := claimer.Claim(ctx, ch, acc, cl)
+	if err != nil {
+		data["error"] = redactRPCError(err).Error()
+		audit("broadcast", data)
+		fmt.Fprintf(w, "%s: claim failed: %v\n", acc.address.Hex(), redactError(err, ch.url))
+		return
+	}
+	data["tx"] = tx.Hash().Hex()
+	audit("broadcast", data)
+	asset := "ETH"
+	if cl.token != nil {
+		asset = cl.token.Hex()
+	}
+	recordTransaction(ch.networkId.String(), acc.address, "claim", asset, tx.Hash())
+	waitCtx, cancel := context.WithTimeout(ctx, claimTimeout)
+	receipt, err := bind.WaitMined(waitCtx, ch.client, tx)
+	cancel()
+	if waitCtx.Err() == context.DeadlineExceeded {
+		fmt.Fprintf(w, "%s: claim not mined after %s [%s]\n", acc.address.Hex(), claimTimeout, tx.Hash().Hex())
+		return
+	}
+	if err != nil || receipt.Status != types.ReceiptStatusSuccessful {
+		fmt.Fprintf(w, "%s: claim failed [%s]\n", acc.address.Hex(), tx.Hash().Hex())
+		return
+	}
+	fmt.Fprintf(w, "%s: claimed %s %s [%s]\n", acc.address.Hex(), formatUnits(cl.amount, dec), unit, tx.Hash().Hex())
+}
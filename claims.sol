@@ -0,0 +1,26 @@
+pragma solidity ^0.5.0;
+
+// MerkleDistributor is the Uniswap Merkle airdrop distributor.
+contract MerkleDistributor {
+    function token() external view returns (address);
+    function isClaimed(uint256 index) external view returns (bool);
+    function claim(uint256 index, address account, uint256 amount, bytes32[] calldata merkleProof) external;
+}
+
+// VestingWallet is the OpenZeppelin vesting wallet, beneficiary() before
+// 5.0 and owner() since.
+contract VestingWallet {
+    function beneficiary() external view returns (address);
+    function owner() external view returns (address);
+    function releasable() external view returns (uint256);
+    function releasable(address token) external view returns (uint256);
+    function release() external;
+    function release(address token) external;
+}
+
+// StakingRewards is the Synthetix staking rewards contract.
+contract StakingRewards {
+    function rewardsToken() external view returns (address);
+    function earned(address account) external view returns (uint256);
+    function getReward() external;
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ageHeader starts every age encrypted file.
+const ageHeader = "age-encryption.org/v1"
+
+// errPlaintext is returned when writing a file unencrypted is forbidden.
+var errPlaintext = errors.New("refusing to write plaintext, --require-encryption is set and no --encrypt-recipient or passphrase given")
+
+// lineKeySalt is the scrypt salt of the line keys of passphrases.
+const lineKeySalt = "ravecc line key"
+
+// cryptKeys are the parsed encryption options.
+type cryptKeys struct {
+	recipients []age.Recipient
+	// lineRecipients seal the lines of append-only files. A passphrase is
+	// replaced by its line key so that lines do not cost a scrypt each.
+	lineRecipients []age.Recipient
+	identities     []age.Identity
+}
+
+var (
+	keysOnce sync.Once
+	keysMemo *cryptKeys
+	keysErr  error
+)
+
+// keys parses the encryption options on first use, once the secrets
+// bundle is applied, reading the recipient and identity files and running
+// the key derivation of the passphrase once per process.
+func keys() (*cryptKeys, error) {
+	keysOnce.Do(func() {
+		keysMemo, keysErr = parseKeys()
+	})
+	return keysMemo, keysErr
+}
+
+func parseKeys() (*cryptKeys, error) {
+	k := &cryptKeys{}
+	for _, r := range opts.EncryptRecipients {
+		if strings.HasPrefix(r, "age1") {
+			recipient, err := age.ParseX25519Recipient(r)
+			if err != nil {
+				return nil, err
+			}
+			k.recipients = append(k.recipients, recipient)
+			continue
+		}
+		f, err := os.Open(r)
+		if err != nil {
+			return nil, err
+		}
+		fileRecipients, err := age.ParseRecipients(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", r, err)
+		}
+		k.recipients = append(k.recipients, fileRecipients...)
+	}
+	k.lineRecipients = k.recipients
+	for _, path := range opts.Identities {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		fileIds, err := age.ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		k.identities = append(k.identities, fileIds...)
+	}
+	if opts.EncryptPassphrase != "" {
+		if len(k.recipients) > 0 {
+			return nil, errors.New("a passphrase can not be combined with recipients")
+		}
+		r, err := age.NewScryptRecipient(opts.EncryptPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		id, err := age.NewScryptIdentity(opts.EncryptPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		lineId, err := lineKey(opts.EncryptPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		k.recipients = []age.Recipient{r}
+		k.lineRecipients = []age.Recipient{lineId.Recipient()}
+		// Lines sealed with the passphrase itself are still read.
+		k.identities = append(k.identities, lineId, id)
+	}
+	return k, nil
+}
+
+// lineKey derives the X25519 key lines are sealed with from passphrase,
+// with the scrypt work factor of age.
+func lineKey(passphrase string) (*age.X25519Identity, error) {
+	secret, err := scrypt.Key([]byte(passphrase), []byte(lineKeySalt), 1<<18, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	return age.ParseX25519Identity(strings.ToUpper(bech32("age-secret-key-", secret)))
+}
+
+// bech32 encodes data with the human readable part hrp, as age encodes its
+// keys.
+func bech32(hrp string, data []byte) string {
+	const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	var values []byte
+	acc, bits := 0, 0
+	for _, b := range data {
+		acc = acc<<8 | int(b)
+		for bits += 8; bits >= 5; bits -= 5 {
+			values = append(values, byte(acc>>(bits-5)&31))
+		}
+	}
+	if bits > 0 {
+		values = append(values, byte(acc<<(5-bits)&31))
+	}
+	polymod := func(values []byte) int {
+		gen := []int{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+		chk := 1
+		for _, v := range values {
+			top := chk >> 25
+			chk = (chk&0x1ffffff)<<5 ^ int(v)
+			for i := 0; i < 5; i++ {
+				if top>>uint(i)&1 == 1 {
+					chk ^= gen[i]
+				}
+			}
+		}
+		return chk
+	}
+	var expanded []byte
+	for _, c := range hrp {
+		expanded = append(expanded, byte(c>>5))
+	}
+	expanded = append(expanded, 0)
+	for _, c := range hrp {
+		expanded = append(expanded, byte(c&31))
+	}
+	mod := polymod(append(append(expanded, values...), 0, 0, 0, 0, 0, 0)) ^ 1
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, v := range values {
+		sb.WriteByte(charset[v])
+	}
+	for i := 0; i < 6; i++ {
+		sb.WriteByte(charset[mod>>uint(5*(5-i))&31])
+	}
+	return sb.String()
+}
+
+// recipients returns the age recipients files are encrypted to, none when
+// encryption is disabled.
+func recipients() ([]age.Recipient, error) {
+	k, err := keys()
+	if err != nil {
+		return nil, err
+	}
+	if len(k.recipients) == 0 && opts.RequireEncryption {
+		return nil, errPlaintext
+	}
+	return k.recipients, nil
+}
+
+// identities returns the age identities encrypted files are read with.
+func identities() ([]age.Identity, error) {
+	k, err := keys()
+	if err != nil {
+		return nil, err
+	}
+	return k.identities, nil
+}
+
+// encryptedFile closes both the age stream and the file under it.
+type encryptedFile struct {
+	io.WriteCloser
+	f *os.File
+}
+
+func (e *encryptedFile) Close() error {
+	err := e.WriteCloser.Close()
+	if cerr := e.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// createFile creates the file at path, encrypted if encryption is enabled.
+func createFile(path string) (io.WriteCloser, error) {
+	rs, err := recipients()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if len(rs) == 0 {
+		return f, nil
+	}
+	w, err := age.Encrypt(f, rs...)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &encryptedFile{WriteCloser: w, f: f}, nil
+}
+
+// writeFile atomically replaces the file at path with data, encrypted if
+// encryption is enabled.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	w, err := createFile(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// decryptedFile reads the plaintext of a file, encrypted or not.
+type decryptedFile struct {
+	io.Reader
+	f *os.File
+}
+
+func (d *decryptedFile) Close() error {
+	return d.f.Close()
+}
+
+// openFile opens the file at path, decrypting it if it is age encrypted.
+func openFile(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	if head, _ := br.Peek(len(ageHeader)); string(head) != ageHeader {
+		return &decryptedFile{Reader: br, f: f}, nil
+	}
+	ids, err := identities()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if len(ids) == 0 {
+		f.Close()
+		return nil, fmt.Errorf("%s is encrypted, use --identity or a passphrase", path)
+	}
+	r, err := age.Decrypt(br, ids...)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &decryptedFile{Reader: r, f: f}, nil
+}
+
+// readFile returns the plaintext content of the file at path.
+func readFile(path string) ([]byte, error) {
+	r, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// sealLine encrypts line for an append-only file of one record per line.
+// The line is returned as is when encryption is disabled.
+func sealLine(line []byte) ([]byte, error) {
+	if _, err := recipients(); err != nil {
+		return nil, err
+	}
+	k, _ := keys()
+	if len(k.lineRecipients) == 0 {
+		return line, nil
+	}
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, k.lineRecipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(line); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+// sealedPrefix starts every line sealed by sealLine, the Base64 of the age
+// header.
+var sealedPrefix = []byte(base64.StdEncoding.EncodeToString([]byte("age-encryption.org/v1")))
+
+// openLine returns the plaintext of a line written by sealLine. Lines not
+// sealed are returned as is.
+func openLine(line []byte) ([]byte, error) {
+	line = bytes.TrimSpace(line)
+	if !bytes.HasPrefix(line, sealedPrefix) {
+		return line, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil {
+		return nil, err
+	}
+	ids, err := identities()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("encrypted line, use --identity or a passphrase")
+	}
+	r, err := age.Decrypt(bytes.NewReader(data), ids...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// encryptionEnv returns the environment passing the encryption options to a
+// child process. Options from the secrets bundle are left out, the daemon
+// passes them with the bundle.
+func encryptionEnv() []string {
+	var env []string
+	if len(opts.EncryptRecipients) > 0 && !fromSecrets["encrypt-recipient"] {
+		env = append(env, "ENCRYPT_RECIPIENT="+strings.Join(opts.EncryptRecipients, ","))
+	}
+	if len(opts.Identities) > 0 && !fromSecrets["identity"] {
+		env = append(env, "IDENTITY="+strings.Join(opts.Identities, ","))
+	}
+	if opts.EncryptPassphrase != "" && !fromSecrets["encrypt-passphrase"] {
+		env = append(env, "ENCRYPT_PASSPHRASE="+opts.EncryptPassphrase)
+	}
+	if opts.RequireEncryption {
+		env = append(env, "REQUIRE_ENCRYPTION=true")
+	}
+	return env
+}
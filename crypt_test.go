@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// setEncryption sets the encryption options for the test, parsing them
+// again on next use.
+func setEncryption(t *testing.T, recipients, identities []string, passphrase string) {
+	saved := opts
+	t.Cleanup(func() {
+		opts = saved
+		keysOnce = sync.Once{}
+	})
+	opts.EncryptRecipients = recipients
+	opts.Identities = identities
+	opts.EncryptPassphrase = passphrase
+	opts.RequireEncryption = false
+	keysOnce = sync.Once{}
+}
+
+// writeIdentity writes a new age identity file and returns its path and
+// recipient.
+func writeIdentity(t *testing.T) (path, recipient string) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(t.TempDir(), "identity.txt")
+	if err := os.WriteFile(path, []byte(id.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, id.Recipient().String()
+}
+
+// checkRoundTrip writes a file and a line and reads them back.
+func checkRoundTrip(t *testing.T, encrypted bool) {
+	t.Helper()
+	data := []byte(`{"address":"0x01"}`)
+	path := filepath.Join(t.TempDir(), "file.json")
+	if err := writeFile(path, data); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bytes.HasPrefix(raw, []byte(ageHeader)); got != encrypted {
+		t.Errorf("file encrypted = %v, want %v", got, encrypted)
+	}
+	if got, err := readFile(path); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("readFile = %q, %v, want %q", got, err, data)
+	}
+
+	sealed, err := sealLine(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bytes.HasPrefix(sealed, sealedPrefix); got != encrypted {
+		t.Errorf("line sealed = %v, want %v", got, encrypted)
+	}
+	if bytes.ContainsAny(sealed, "\n") {
+		t.Errorf("sealed line %q spans lines", sealed)
+	}
+	if got, err := openLine(append(sealed, '\n')); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("openLine = %q, %v, want %q", got, err, data)
+	}
+}
+
+func TestCryptPlaintext(t *testing.T) {
+	setEncryption(t, nil, nil, "")
+	checkRoundTrip(t, false)
+	opts.RequireEncryption = true
+	if err := writeFile(filepath.Join(t.TempDir(), "file.json"), nil); err != errPlaintext {
+		t.Errorf("writeFile = %v, want %v", err, errPlaintext)
+	}
+	if _, err := sealLine(nil); err != errPlaintext {
+		t.Errorf("sealLine = %v, want %v", err, errPlaintext)
+	}
+}
+
+func TestCryptRecipient(t *testing.T) {
+	identity, recipient := writeIdentity(t)
+	setEncryption(t, []string{recipient}, []string{identity}, "")
+	checkRoundTrip(t, true)
+
+	// A recipients file and the identity of another key.
+	recipients := filepath.Join(t.TempDir(), "recipients.txt")
+	if err := os.WriteFile(recipients, []byte("# ops\n"+recipient+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := writeIdentity(t)
+	setEncryption(t, []string{recipients}, []string{other}, "")
+	path := filepath.Join(t.TempDir(), "file.json")
+	if err := writeFile(path, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readFile(path); err == nil {
+		t.Error("file read with another identity")
+	}
+	sealed, err := sealLine([]byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openLine(sealed); err == nil {
+		t.Error("line read with another identity")
+	}
+	setEncryption(t, nil, nil, "")
+	if _, err := readFile(path); err == nil {
+		t.Error("file read without identity")
+	}
+}
+
+func TestCryptPassphrase(t *testing.T) {
+	setEncryption(t, nil, nil, "correct horse battery staple")
+	checkRoundTrip(t, true)
+
+	// Lines sealed with the passphrase itself, before line keys.
+	r, err := age.NewScryptRecipient(opts.EncryptPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.lineRecipients = []age.Recipient{r}
+	sealed, err := sealLine([]byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setEncryption(t, nil, nil, opts.EncryptPassphrase)
+	if got, err := openLine(sealed); err != nil || string(got) != "{}" {
+		t.Errorf("openLine = %q, %v, want {}", got, err)
+	}
+
+	_, recipient := writeIdentity(t)
+	setEncryption(t, []string{recipient}, nil, "passphrase")
+	if _, err := keys(); err == nil {
+		t.Error("passphrase combined with a recipient")
+	}
+}
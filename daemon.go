@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// job is a scheduled run of the tool, see the daemon command.
+type job struct {
+	Name string `json:"name"`
+	// Kind is scan, sweep, check or report.
+	Kind     string   `json:"kind"`
+	Schedule string   `json:"schedule"`
+	Jitter   string   `json:"jitter"`
+	Profile  string   `json:"profile"`
+	Args     []string `json:"args"`
+
+	schedule cron.Schedule
+	jitter   time.Duration
+	mu       sync.Mutex
+	running  bool
+}
+
+// daemonConfig is the content of a daemon --config file.
+type daemonConfig struct {
+	// State is the file the last run of every job is saved to.
+	State string `json:"state"`
+	// ReportDir is the directory report jobs write to.
+	ReportDir string `json:"report_dir"`
+	// Profiles are named lists of global options.
+	Profiles map[string][]string `json:"profiles"`
+	Jobs     []*job              `json:"jobs"`
+}
+
+// jobState is the persisted state of a job.
+type jobState struct {
+	LastRun      time.Time `json:"last_run"`
+	LastDuration string    `json:"last_duration"`
+	LastStatus   string    `json:"last_status"`
+}
+
+type daemonCommand struct {
+	Config           string `long:"config" required:"true" description:"JSON daemon configuration file"`
+	KillSwitchListen string `long:"kill-switch-listen" description:"Loopback address serving the --kill-switch over HTTP, e.g. 127.0.0.1:8547"`
+	KillSwitchToken  string `long:"kill-switch-token" env:"KILL_SWITCH_TOKEN" description:"Bearer token of the kill switch HTTP endpoint"`
+
+	cfg   daemonConfig
+	mu    sync.Mutex
+	state map[string]*jobState
+}
+
+func (c *daemonCommand) Execute(args []string) error {
+	data, err := readFile(c.Config)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &c.cfg); err != nil {
+		return fmt.Errorf("%s: %v", c.Config, err)
+	}
+	if c.cfg.State == "" {
+		c.cfg.State = "ravecc-daemon.json"
+	}
+	if c.cfg.ReportDir == "" {
+		c.cfg.ReportDir = "."
+	}
+	c.state = make(map[string]*jobState)
+	if data, err := readFile(c.cfg.State); err == nil {
+		if err := json.Unmarshal(data, &c.state); err != nil {
+			return fmt.Errorf("%s: %v", c.cfg.State, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, j := range c.cfg.Jobs {
+		if err := c.prepare(j); err != nil {
+			return fmt.Errorf("job %s: %v", j.Name, err)
+		}
+	}
+	if c.KillSwitchListen != "" {
+		if opts.KillSwitch == "" {
+			return fmt.Errorf("no kill switch, use --kill-switch")
+		}
+		if err := serveKillSwitch(c.KillSwitchListen, c.KillSwitchToken); err != nil {
+			return err
+		}
+	}
+	if st, err := killSwitchState(); err != nil {
+		return err
+	} else if st != nil {
+		log.Printf("Kill switch engaged by %s at %s, sweeps are paused", st.By, st.Time.Format(time.RFC3339))
+	}
+
+	var wg sync.WaitGroup
+	for _, j := range c.cfg.Jobs {
+		wg.Add(1)
+		go func(j *job) {
+			defer wg.Done()
+			c.loop(j)
+		}(j)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// prepare validates j and parses its schedule.
+func (c *daemonCommand) prepare(j *job) error {
+	var err error
+	if j.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if j.schedule, err = cron.ParseStandard(j.Schedule); err != nil {
+		return err
+	}
+	if j.Jitter != "" {
+		if j.jitter, err = time.ParseDuration(j.Jitter); err != nil {
+			return err
+		}
+	}
+	if _, ok := c.cfg.Profiles[j.Profile]; !ok && j.Profile != "" {
+		return fmt.Errorf("unknown profile %q", j.Profile)
+	}
+	switch j.Kind {
+	case "scan", "report", "check":
+		for _, name := range sweepOptions {
+			if hasOption(c.args(j), "--"+name) {
+				return fmt.Errorf("%s jobs must not set --%s", j.Kind, name)
+			}
+		}
+	case "sweep":
+		if !hasOption(c.args(j), "--swipe-address") {
+			return fmt.Errorf("sweep jobs need --swipe-address")
+		}
+	default:
+		return fmt.Errorf("unknown kind %q", j.Kind)
+	}
+	return nil
+}
+
+// sweepOptions are the long names of the options making a run move funds,
+// never given to the jobs that are not sweeps.
+var sweepOptions = []string{"swipe-address", "forwarder-operator"}
+
+// withoutEnv returns env without the variables of the options names.
+func withoutEnv(env []string, names []string) []string {
+	envs := optionEnvs()
+	var kept []string
+	for _, v := range env {
+		drop := false
+		for _, name := range names {
+			if strings.HasPrefix(v, envs[name]+"=") {
+				drop = true
+			}
+		}
+		if !drop {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// args returns the command line of j. The arguments of check jobs follow
+// the check command.
+func (c *daemonCommand) args(j *job) []string {
+	args := append([]string{}, c.cfg.Profiles[j.Profile]...)
+	if j.Kind == "check" {
+		args = append(args, "check")
+	}
+	return append(args, j.Args...)
+}
+
+func hasOption(args []string, name string) bool {
+	for _, arg := range args {
+		if arg == name || strings.HasPrefix(arg, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// loop runs j on its schedule until ctx is done. A run missed while the
+// daemon was stopped is caught up at startup.
+func (c *daemonCommand) loop(j *job) {
+	last := time.Now()
+	c.mu.Lock()
+	if st, ok := c.state[j.Name]; ok {
+		last = st.LastRun
+	}
+	c.mu.Unlock()
+	for {
+		next := j.schedule.Next(last)
+		if j.jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(j.jitter))))
+		}
+		log.Printf("Job %s: next run at %s", j.Name, next.Format(time.RFC3339))
+		select {
+		case <-time.After(time.Until(next)):
+		case <-ctx.Done():
+			return
+		}
+		last = time.Now()
+		go c.run(j)
+	}
+}
+
+// run runs j once unless it is already running, in this process or another
+// daemon sharing the state file.
+func (c *daemonCommand) run(j *job) {
+	j.mu.Lock()
+	if j.running {
+		j.mu.Unlock()
+		log.Printf("Job %s: previous run still in progress, skipping", j.Name)
+		return
+	}
+	j.running = true
+	j.mu.Unlock()
+	defer func() {
+		j.mu.Lock()
+		j.running = false
+		j.mu.Unlock()
+	}()
+
+	lock, err := os.OpenFile(c.cfg.State+"."+j.Name+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		log.Printf("Job %s: %v", j.Name, err)
+		return
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		log.Printf("Job %s: locked by another process, skipping", j.Name)
+		return
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	if j.Kind == "sweep" {
+		if err := halted(); err != nil {
+			log.Printf("Job %s: skipped: %v", j.Name, err)
+			return
+		}
+	}
+	args := c.args(j)
+	if j.Kind == "report" {
+		name := fmt.Sprintf("%s-%s.txt", j.Name, time.Now().UTC().Format("20060102T150405Z"))
+		args = append(args, "--output="+filepath.Join(c.cfg.ReportDir, name))
+	}
+	self, err := os.Executable()
+	if err != nil {
+		log.Printf("Job %s: %v", j.Name, err)
+		return
+	}
+
+	start := time.Now()
+	log.Printf("Job %s: starting", j.Name)
+	env := os.Environ()
+	if j.Kind != "sweep" {
+		// The environment, or a secrets bundle, could still set a sweep
+		// option: drop them and make the child refuse to sweep.
+		env = withoutEnv(env, sweepOptions)
+		args = append([]string{"--no-sweep"}, args...)
+	}
+	cmd := exec.CommandContext(ctx, self, args...)
+	cmd.Env = append(env, encryptionEnv()...)
+	if opts.KillSwitch != "" {
+		cmd.Env = append(cmd.Env, "KILL_SWITCH="+opts.KillSwitch)
+	}
+	// Jobs may run at the same time and the event outbox is locked.
+	cmd.Env = append(cmd.Env, eventsOutboxEnv+"="+c.cfg.State+"."+j.Name+".outbox")
+	if secrets != nil {
+		// Pass the bundle on a pipe rather than in the environment, so
+		// that the decrypted values never leave memory.
+		r, w, err := os.Pipe()
+		if err != nil {
+			log.Printf("Job %s: %v", j.Name, err)
+			return
+		}
+		defer r.Close()
+		cmd.ExtraFiles = []*os.File{r}
+		cmd.Env = append(withoutEnv(cmd.Env, []string{"secrets"}), secretsFdEnv+"=3")
+		go func(bundle map[string]interface{}) {
+			defer w.Close()
+			if err := json.NewEncoder(w).Encode(bundle); err != nil {
+				log.Printf("Job %s: passing secrets: %v", j.Name, err)
+			}
+		}(jobSecrets(j.Kind == "sweep"))
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	status := "ok"
+	if err := cmd.Run(); err != nil {
+		status = err.Error()
+	}
+	duration := time.Since(start)
+	log.Printf("Job %s: finished in %s: %s", j.Name, duration, status)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state[j.Name] = &jobState{LastRun: start, LastDuration: duration.String(), LastStatus: status}
+	if err := c.saveState(); err != nil {
+		log.Printf("Job %s: saving state: %v", j.Name, err)
+	}
+}
+
+// saveState atomically writes the state file.
+func (c *daemonCommand) saveState() error {
+	data, err := json.MarshalIndent(c.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(c.cfg.State, data)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// maxTopicAddresses is the number of addresses filtered per log query.
+const maxTopicAddresses = 500
+
+type depositsCommand struct {
+	Customers     string        `long:"customers" required:"true" description:"CSV file of deposit address,customer id"`
+	Confirmations uint64        `long:"confirmations" default:"12" description:"Blocks a deposit must be buried under to be credited"`
+	FromBlock     uint64        `long:"from-block" description:"First block scanned when the ledger has no cursor for the network"`
+	MaxBlocks     uint64        `long:"max-blocks" default:"5000" description:"Maximum number of blocks scanned per network and run"`
+	ReorgDepth    uint64        `long:"reorg-depth" default:"128" description:"Depth of the credits checked against reorgs"`
+	Watch         bool          `long:"watch" description:"Keep running, reporting token deposits as they are mined"`
+	Interval      time.Duration `long:"interval" default:"15s" description:"Delay between two crediting runs with --watch"`
+	Heartbeat     time.Duration `long:"heartbeat" default:"30s" description:"Delay between two checks of the ws and IPC connections with --watch"`
+}
+
+// loadCustomers reads a CSV file of address,customer id.
+func loadCustomers(path string) (map[common.Address]string, error) {
+	r, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	customers := make(map[common.Address]string)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		str := strings.TrimSpace(scanner.Text())
+		if str == "" || strings.HasPrefix(str, "#") {
+			continue
+		}
+		fields := strings.SplitN(str, ",", 2)
+		if len(fields) != 2 || !common.IsHexAddress(strings.TrimSpace(fields[0])) {
+			return nil, fmt.Errorf("%s:%d: expected address,customer id", path, line)
+		}
+		customers[common.HexToAddress(strings.TrimSpace(fields[0]))] = strings.TrimSpace(fields[1])
+	}
+	return customers, scanner.Err()
+}
+
+func (c *depositsCommand) Execute(args []string) error {
+	if ledger == nil {
+		return fmt.Errorf("no ledger, use --ledger")
+	}
+	customers, err := loadCustomers(c.Customers)
+	if err != nil {
+		return err
+	}
+	var addresses []common.Address
+	for addr := range customers {
+		addresses = append(addresses, addr)
+	}
+	var contractAddresses []common.Address
+	for _, contractAddr := range opts.ContractAddresses {
+		contractAddresses = append(contractAddresses, common.HexToAddress(contractAddr))
+	}
+	if len(opts.RPCURLs) == 0 {
+		return fmt.Errorf("no ethereum client, use --rpc-url")
+	}
+	chains := dialChains(ctx, opts.RPCURLs)
+	if c.Watch {
+		return c.watch(ctx, chains, customers, addresses, contractAddresses)
+	}
+	for _, ch := range chains {
+		if err := c.process(ctx, ch, customers, addresses, contractAddresses); err != nil {
+			return fmt.Errorf("network %s: %v", ch.networkId, err)
+		}
+	}
+	screen.report(os.Stdout)
+	return nil
+}
+
+// watch credits the deposits every interval until ctx is done. On ws and
+// IPC endpoints, token transfers to the addresses are also reported as
+// soon as they are mined, and the reconnecting transport replaces the
+// client of the chain.
+func (c *depositsCommand) watch(ctx context.Context, chains []*chain, customers map[common.Address]string, addresses, contractAddresses []common.Address) error {
+	transports := make(map[*chain]*transport)
+	for _, ch := range chains {
+		if !isPersistent(ch.url) {
+			continue
+		}
+		t, err := dialTransport(ctx, ch.url, c.Heartbeat)
+		if err != nil {
+			return fmt.Errorf("network %s: %v", ch.networkId, err)
+		}
+		transports[ch] = t
+		if len(contractAddresses) == 0 {
+			continue
+		}
+		transfers := make(chan *ERC20Transfer)
+		go func(ch *chain) {
+			if err := watchTransfers(ctx, t, contractAddresses, addresses, transfers); err != nil && ctx.Err() == nil {
+				log.Printf("Network %s: %v", ch.networkId, redactError(err, ch.url))
+			}
+		}(ch)
+		go func(ch *chain) {
+			for ev := range transfers {
+				fmt.Printf("Pending %s %s to %s [%s] from %s [%s]\n", ev.Tokens, ev.Raw.Address.Hex(), customers[ev.To], ev.To.Hex(), ev.From.Hex(), depositId(ev.Raw.TxHash, int(ev.Raw.Index)))
+			}
+		}(ch)
+	}
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		for _, ch := range chains {
+			if t, ok := transports[ch]; ok {
+				client, _, err := t.conn(ctx)
+				if err != nil {
+					return err
+				}
+				ch.client = client
+			}
+			if err := c.process(ctx, ch, customers, addresses, contractAddresses); err != nil {
+				log.Printf("Network %s: %v", ch.networkId, redactError(err, ch.url))
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			screen.report(os.Stdout)
+			return nil
+		}
+	}
+}
+
+// process credits the deposits of ch since the ledger cursor.
+func (c *depositsCommand) process(ctx context.Context, ch *chain, customers map[common.Address]string, addresses, contractAddresses []common.Address) error {
+	networkId := ch.networkId.String()
+	head, err := ch.client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if head.Number.Uint64() < c.Confirmations {
+		return nil
+	}
+	safe := head.Number.Uint64() - c.Confirmations
+
+	start := c.FromBlock
+	if cur := ledger.cursor(networkId); cur != nil {
+		start = cur.Block + 1
+	}
+	if start, err = c.checkReorg(ctx, ch, start); err != nil {
+		return err
+	}
+	if start > safe {
+		return nil
+	}
+	end := safe
+	if end-start+1 > c.MaxBlocks {
+		end = start + c.MaxBlocks - 1
+	}
+	log.Printf("Network %s: scanning deposits of blocks %d to %d", networkId, start, end)
+
+	for _, contractAddr := range contractAddresses {
+		filterer, err := NewERC20Filterer(contractAddr, ch.client)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(addresses); i += maxTopicAddresses {
+			j := i + maxTopicAddresses
+			if j > len(addresses) {
+				j = len(addresses)
+			}
+			it, err := filterer.FilterTransfer(&bind.FilterOpts{Start: start, End: &end, Context: ctx}, nil, addresses[i:j])
+			if err != nil {
+				return err
+			}
+			for it.Next() {
+				ev := it.Event
+				if ev.Raw.Removed {
+					continue
+				}
+				if err := c.credit(ch, customers, &ledgerEntry{
+					NetworkId: networkId,
+					Account:   ev.To,
+					From:      ev.From,
+					Asset:     contractAddr.Hex(),
+					Amount:    ev.Tokens.String(),
+					TxHash:    ev.Raw.TxHash,
+					LogIndex:  int(ev.Raw.Index),
+					Block:     ev.Raw.BlockNumber,
+					BlockHash: ev.Raw.BlockHash,
+				}); err != nil {
+					it.Close()
+					return err
+				}
+			}
+			err = it.Error()
+			it.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var endHash common.Hash
+	signer := types.LatestSignerForChainID(ch.networkId)
+	for n := start; n <= end; n++ {
+		block, err := ch.client.BlockByNumber(ctx, new(big.Int).SetUint64(n))
+		if err != nil {
+			return err
+		}
+		endHash = block.Hash()
+		for _, tx := range block.Transactions() {
+			if tx.To() == nil || tx.Value().Sign() == 0 {
+				continue
+			}
+			if _, ok := customers[*tx.To()]; !ok {
+				continue
+			}
+			receipt, err := ch.client.TransactionReceipt(ctx, tx.Hash())
+			if err != nil {
+				return err
+			}
+			if receipt.Status != types.ReceiptStatusSuccessful {
+				continue
+			}
+			from, err := types.Sender(signer, tx)
+			if err != nil {
+				return fmt.Errorf("deposit %s: sender: %v", tx.Hash().Hex(), err)
+			}
+			if err := c.credit(ch, customers, &ledgerEntry{
+				NetworkId: networkId,
+				Account:   *tx.To(),
+				From:      from,
+				Asset:     "ETH",
+				Amount:    tx.Value().String(),
+				TxHash:    tx.Hash(),
+				LogIndex:  -1,
+				Block:     n,
+				BlockHash: block.Hash(),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return ledger.setCursor(networkId, end, endHash)
+}
+
+// credit writes a confirmed deposit to the ledger unless already credited.
+func (c *depositsCommand) credit(ch *chain, customers map[common.Address]string, e *ledgerEntry) error {
+	e.Customer = customers[e.Account]
+	if ledger.isCredited(depositId(e.TxHash, e.LogIndex)) {
+		return nil
+	}
+	var err error
+	if e.Screening, err = screen.screenDeposit(e.Account, e.From, depositId(e.TxHash, e.LogIndex)); err != nil {
+		return err
+	}
+	ok, err := ledger.credit(e)
+	if err != nil || !ok {
+		return err
+	}
+	recordDeposit(e)
+	publishDeposit(e)
+	fmt.Printf("Credited %s %s to %s [%s] from %s [%s]\n", e.Amount, e.Asset, e.Customer, e.Account.Hex(), e.From.Hex(), e.Id)
+	if e.Screening != "" {
+		fmt.Printf("Flagged %s: %s, account quarantined\n", e.Id, e.Screening)
+	}
+	return nil
+}
+
+// checkReorg reverses the recent credits whose block left the canonical
+// chain and returns the block the scan must restart from.
+func (c *depositsCommand) checkReorg(ctx context.Context, ch *chain, start uint64) (uint64, error) {
+	networkId := ch.networkId.String()
+	since := uint64(0)
+	if start > c.ReorgDepth {
+		since = start - c.ReorgDepth
+	}
+	canonical := make(map[uint64]common.Hash)
+	for _, e := range ledger.creditsSince(networkId, since) {
+		hash, ok := canonical[e.Block]
+		if !ok {
+			header, err := ch.client.HeaderByNumber(ctx, new(big.Int).SetUint64(e.Block))
+			if err != nil {
+				return start, err
+			}
+			hash = header.Hash()
+			canonical[e.Block] = hash
+		}
+		if hash == e.BlockHash {
+			continue
+		}
+		log.Printf("Network %s: block %d reorganized, reversing %s", networkId, e.Block, e.Id)
+		if err := ledger.reverse(e.Id); err != nil {
+			return start, err
+		}
+		recordReversal(e.Id)
+		fmt.Printf("Reversed %s %s of %s [%s] [%s]\n", e.Amount, e.Asset, e.Customer, e.Account.Hex(), e.Id)
+		if e.Block < start {
+			start = e.Block
+		}
+	}
+	return start, nil
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/nats-io/nats.go"
+)
+
+// eventVersion is the version of the event payloads, bumped on any
+// incompatible change.
+const eventVersion = 1
+
+const (
+	// maxPublishDelay bounds the delay between two publication attempts.
+	maxPublishDelay = time.Minute
+	// drainTimeout bounds the time spent publishing the outbox on exit.
+	drainTimeout = 10 * time.Second
+	// receiptPoll is the delay between two receipt queries of a sweep.
+	receiptPoll = 5 * time.Second
+)
+
+// eventsOutboxEnv names the environment variable giving a daemon job an
+// outbox of its own, overriding the one of the --events file.
+const eventsOutboxEnv = "EVENTS_OUTBOX"
+
+// envelope is a published event. Id is unique per event and used by the
+// server to drop the duplicates of a retried publication.
+type envelope struct {
+	Version   int             `json:"version"`
+	Id        string          `json:"id"`
+	Type      string          `json:"type"`
+	NetworkId string          `json:"network_id"`
+	Time      time.Time       `json:"time"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// balanceEvent is the data of a scan.result event.
+type balanceEvent struct {
+	Account  common.Address `json:"account"`
+	Asset    string         `json:"asset"`
+	Symbol   string         `json:"symbol"`
+	Decimals uint           `json:"decimals"`
+	Amount   string         `json:"amount"`
+}
+
+// sweepEvent is the data of the sweep events. Amounts are raw, values in
+// the unit of the prices.
+type sweepEvent struct {
+	Account  common.Address `json:"account"`
+	Asset    string         `json:"asset"`
+	Symbol   string         `json:"symbol,omitempty"`
+	Decimals uint           `json:"decimals,omitempty"`
+	Amount   string         `json:"amount,omitempty"`
+	Fee      string         `json:"fee,omitempty"`
+	Value    string         `json:"value,omitempty"`
+	TxHash   *common.Hash   `json:"tx_hash,omitempty"`
+	Block    uint64         `json:"block,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// eventsConfig is the content of the --events file.
+type eventsConfig struct {
+	URL string `json:"url"`
+	// Creds is a NATS credentials file.
+	Creds string `json:"creds"`
+	// Prefix starts every subject, prefix.network id.type.
+	Prefix string `json:"prefix"`
+	// Stream, if set, is created to capture the subjects when missing.
+	Stream string `json:"stream"`
+	// Outbox holds the events until the server acknowledges them.
+	Outbox string `json:"outbox"`
+	// ConfirmTimeout bounds the wait for the receipt of a sweep.
+	ConfirmTimeout string `json:"confirm_timeout"`
+}
+
+// publisher publishes events to NATS JetStream through an outbox, at
+// least once.
+type publisher struct {
+	eventsConfig
+	confirmTimeout time.Duration
+	nc             *nats.Conn
+	js             nats.JetStreamContext
+	outbox         *outbox
+
+	wake     chan struct{}
+	closing  chan struct{}
+	done     chan struct{}
+	watchers sync.WaitGroup
+}
+
+// events is the event publisher of the process, nil when disabled.
+var events *publisher
+
+// loadPublisher reads the --events file, connects to NATS and starts
+// publishing the events left in the outbox.
+func loadPublisher(path string) (*publisher, error) {
+	data, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &publisher{
+		confirmTimeout: 5 * time.Minute,
+		wake:           make(chan struct{}, 1),
+		closing:        make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	if err := json.Unmarshal(data, &p.eventsConfig); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if p.URL == "" {
+		p.URL = nats.DefaultURL
+	}
+	if p.Prefix == "" {
+		p.Prefix = "ravecc"
+	}
+	if outbox := os.Getenv(eventsOutboxEnv); outbox != "" {
+		p.Outbox = outbox
+	} else if p.Outbox == "" {
+		p.Outbox = path + ".outbox"
+	}
+	if p.ConfirmTimeout != "" {
+		if p.confirmTimeout, err = time.ParseDuration(p.ConfirmTimeout); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if p.outbox, err = openOutbox(p.Outbox); err != nil {
+		return nil, err
+	}
+	options := []nats.Option{nats.Name("ravecc-list"), nats.MaxReconnects(-1)}
+	if p.Creds != "" {
+		options = append(options, nats.UserCredentials(p.Creds))
+	}
+	if p.nc, err = nats.Connect(p.URL, options...); err != nil {
+		return nil, fmt.Errorf("nats %s: %v", redactURL(p.URL), err)
+	}
+	if p.js, err = p.nc.JetStream(); err != nil {
+		p.nc.Close()
+		return nil, err
+	}
+	if p.Stream != "" {
+		if _, err := p.js.StreamInfo(p.Stream); errors.Is(err, nats.ErrStreamNotFound) {
+			_, err = p.js.AddStream(&nats.StreamConfig{Name: p.Stream, Subjects: []string{p.Prefix + ".>"}})
+			if err != nil {
+				p.nc.Close()
+				return nil, fmt.Errorf("stream %s: %v", p.Stream, err)
+			}
+		} else if err != nil {
+			p.nc.Close()
+			return nil, fmt.Errorf("stream %s: %v", p.Stream, err)
+		}
+	}
+	go p.run()
+	return p, nil
+}
+
+// emit writes an event to the outbox, from where it is published. A
+// failure to write is fatal, like for the ledger.
+func (p *publisher) emit(kind, networkId string, data interface{}) {
+	raw, err := json.Marshal(data)
+	check(err)
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	check(err)
+	check(p.outbox.add(&envelope{
+		Version:   eventVersion,
+		Id:        hex.EncodeToString(id),
+		Type:      kind,
+		NetworkId: networkId,
+		Time:      time.Now().UTC(),
+		Data:      raw,
+	}))
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run publishes the events of the outbox in order, retrying with backoff
+// until the server acknowledges them, and returns once the outbox is
+// empty after Close.
+func (p *publisher) run() {
+	defer close(p.done)
+	delay := time.Second
+	for {
+		e := p.outbox.next()
+		if e == nil {
+			select {
+			case <-p.wake:
+				continue
+			case <-p.closing:
+				return
+			}
+		}
+		line, err := json.Marshal(e)
+		if err == nil {
+			_, err = p.js.Publish(fmt.Sprintf("%s.%s.%s", p.Prefix, e.NetworkId, e.Type), line, nats.MsgId(e.Id))
+		}
+		if err != nil {
+			log.Printf("Events: publishing %s: %v, retrying in %v", e.Id, err, delay)
+			time.Sleep(delay)
+			if delay *= 2; delay > maxPublishDelay {
+				delay = maxPublishDelay
+			}
+			continue
+		}
+		delay = time.Second
+		if err := p.outbox.ack(e.Id); err != nil {
+			log.Printf("Events: %v", err)
+		}
+	}
+}
+
+// confirm waits in the background for the receipt of a sweep and emits
+// sweep.confirmed or sweep.failed. The wait ends with the process context.
+func (p *publisher) confirm(ch *chain, ev sweepEvent) {
+	p.watchers.Add(1)
+	go func() {
+		defer p.watchers.Done()
+		wctx, cancel := context.WithTimeout(ctx, p.confirmTimeout)
+		defer cancel()
+		for {
+			receipt, err := ch.client.TransactionReceipt(wctx, *ev.TxHash)
+			if err == nil {
+				ev.Block = receipt.BlockNumber.Uint64()
+				if receipt.Status == types.ReceiptStatusSuccessful {
+					p.emit("sweep.confirmed", ch.networkId.String(), ev)
+				} else {
+					ev.Error = "reverted"
+					p.emit("sweep.failed", ch.networkId.String(), ev)
+				}
+				return
+			}
+			if err != ethereum.NotFound {
+				log.Printf("Events: receipt of %s: %v", ev.TxHash.Hex(), redactError(err, ch.url))
+			}
+			select {
+			case <-wctx.Done():
+				if ctx.Err() != nil {
+					log.Printf("Events: %s: interrupted before its receipt", ev.TxHash.Hex())
+				} else {
+					log.Printf("Events: %s not mined after %v", ev.TxHash.Hex(), p.confirmTimeout)
+				}
+				return
+			case <-time.After(receiptPoll):
+			}
+		}
+	}()
+}
+
+// Close waits for the pending receipts, then publishes what it can of the
+// outbox. Whatever is left is published by the next run.
+func (p *publisher) Close() error {
+	p.watchers.Wait()
+	close(p.closing)
+	select {
+	case <-p.done:
+	case <-time.After(drainTimeout):
+		log.Printf("Events: %d events left in the outbox %s", p.outbox.len(), p.Outbox)
+	}
+	p.nc.Close()
+	return p.outbox.Close()
+}
+
+// publishBalance emits the scan.result event of a balance if enabled.
+func publishBalance(b balance) {
+	if events == nil {
+		return
+	}
+	asset := "ETH"
+	if b.token != nil {
+		asset = b.token.Hex()
+	}
+	events.emit("scan.result", b.networkId.String(), balanceEvent{
+		Account:  b.account,
+		Asset:    asset,
+		Symbol:   b.info.symbol,
+		Decimals: b.info.decimals,
+		Amount:   b.amount.String(),
+	})
+}
+
+// publishDeposit emits the deposit.detected event of a credit if enabled.
+func publishDeposit(e *ledgerEntry) {
+	if events == nil {
+		return
+	}
+	events.emit("deposit.detected", e.NetworkId, e)
+}
+
+// publishPlanned emits the sweep.planned event of an intent if enabled.
+func publishPlanned(in sweepIntent) {
+	if events == nil {
+		return
+	}
+	ev := sweepEvent{
+		Account:  in.account,
+		Asset:    in.asset,
+		Symbol:   in.symbol,
+		Decimals: in.decimals,
+		Amount:   in.amount.String(),
+	}
+	if in.fee != nil {
+		ev.Fee = in.fee.String()
+	}
+	if in.value != nil {
+		ev.Value = ratString(in.value)
+	}
+	events.emit("sweep.planned", in.networkId.String(), ev)
+}
+
+// publishBroadcast emits the sweep.broadcast event of a transaction and
+// watches for its receipt if enabled. An empty tx is a sweep refused before
+// broadcast, by the kill switch or for its fee, and emits sweep.failed.
+func publishBroadcast(ch *chain, account common.Address, asset string, tx common.Hash) {
+	if events == nil {
+		return
+	}
+	if tx == (common.Hash{}) {
+		publishFailed(ch.networkId, account, asset, errors.New("not broadcast"))
+		return
+	}
+	ev := sweepEvent{Account: account, Asset: asset, TxHash: &tx}
+	events.emit("sweep.broadcast", ch.networkId.String(), ev)
+	events.confirm(ch, ev)
+}
+
+// publishFailed emits the sweep.failed event of a sweep that could not be
+// broadcast if enabled.
+func publishFailed(networkId *big.Int, account common.Address, asset string, err error) {
+	if events == nil {
+		return
+	}
+	events.emit("sweep.failed", networkId.String(), sweepEvent{Account: account, Asset: asset, Error: redactRPCError(err).Error()})
+}
+
+// outboxEntry is a line of the outbox, an event or the acknowledgment of
+// one.
+type outboxEntry struct {
+	Event *envelope `json:"event,omitempty"`
+	Ack   string    `json:"ack,omitempty"`
+}
+
+// outbox is an append-only file of the events not acknowledged yet,
+// compacted when opened.
+type outbox struct {
+	mu      sync.Mutex
+	f       *os.File
+	lock    *os.File
+	pending []*envelope
+}
+
+// openOutbox loads the events left in the outbox at path and rewrites it
+// with them only. The outbox is locked for the life of the process since
+// another process rewriting it would lose the events.
+func openOutbox(path string) (*outbox, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("outbox %s is used by another process, give each process its own: %v", path, err)
+	}
+	o := &outbox{lock: lock}
+	if r, err := openFile(path); err == nil {
+		acked := make(map[string]bool)
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+		n := 0
+		for scanner.Scan() {
+			n++
+			line, err := openLine(scanner.Bytes())
+			if err != nil {
+				r.Close()
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			var e outboxEntry
+			if err := json.Unmarshal(line, &e); err != nil {
+				r.Close()
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			if e.Event != nil {
+				o.pending = append(o.pending, e.Event)
+			}
+			if e.Ack != "" {
+				acked[e.Ack] = true
+			}
+		}
+		err = scanner.Err()
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		pending := o.pending[:0]
+		for _, e := range o.pending {
+			if !acked[e.Id] {
+				pending = append(pending, e)
+			}
+		}
+		o.pending = pending
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	o.f = f
+	for _, e := range o.pending {
+		if err := o.write(&outboxEntry{Event: e}); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if len(o.pending) > 0 {
+		log.Printf("Events: %d events left in the outbox %s", len(o.pending), path)
+	}
+	return o, nil
+}
+
+// write appends an entry to the outbox file.
+func (o *outbox) write(e *outboxEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if line, err = sealLine(line); err != nil {
+		return err
+	}
+	if _, err := o.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return o.f.Sync()
+}
+
+func (o *outbox) add(e *envelope) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.write(&outboxEntry{Event: e}); err != nil {
+		return err
+	}
+	o.pending = append(o.pending, e)
+	return nil
+}
+
+// next returns the oldest event not acknowledged, nil if none.
+func (o *outbox) next() *envelope {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.pending) == 0 {
+		return nil
+	}
+	return o.pending[0]
+}
+
+func (o *outbox) ack(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, e := range o.pending {
+		if e.Id == id {
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			break
+		}
+	}
+	return o.write(&outboxEntry{Ack: id})
+}
+
+func (o *outbox) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+func (o *outbox) Close() error {
+	defer o.lock.Close()
+	return o.f.Close()
+}
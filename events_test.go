@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// startNATS runs an embedded JetStream server and returns its url.
+func startNATS(t *testing.T) string {
+	s, err := natsserver.NewServer(&natsserver.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(s.Shutdown)
+	return s.ClientURL()
+}
+
+// writeEventsFile writes an --events file publishing to url and returns
+// its path and the path of its outbox.
+func writeEventsFile(t *testing.T, url string) (path, outboxPath string) {
+	t.Setenv(eventsOutboxEnv, "")
+	dir := t.TempDir()
+	outboxPath = filepath.Join(dir, "events.outbox")
+	data, err := json.Marshal(eventsConfig{URL: url, Prefix: "test", Stream: "TEST", Outbox: outboxPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, "events.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, outboxPath
+}
+
+// published returns the events of the TEST stream.
+func published(t *testing.T, url string) []envelope {
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := js.StreamInfo("TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelopes []envelope
+	for seq := uint64(1); seq <= info.State.Msgs; seq++ {
+		msg, err := js.GetMsg("TEST", seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e envelope
+		if err := json.Unmarshal(msg.Data, &e); err != nil {
+			t.Fatal(err)
+		}
+		if want := "test." + e.NetworkId + "." + e.Type; msg.Subject != want {
+			t.Errorf("event %s published on %s, want %s", e.Id, msg.Subject, want)
+		}
+		envelopes = append(envelopes, e)
+	}
+	return envelopes
+}
+
+// leaveInOutbox writes events to the outbox at path as a process stopped
+// before publishing them would.
+func leaveInOutbox(t *testing.T, path string, ids ...string) {
+	o, err := openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	for _, id := range ids {
+		e := &envelope{Version: eventVersion, Id: id, Type: "sweep.planned", NetworkId: "1", Time: time.Now().UTC(), Data: json.RawMessage(`{}`)}
+		if err := o.add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// publishAll starts a publisher of the events file at path and closes it
+// once its outbox is published.
+func publishAll(t *testing.T, path string, emit func(p *publisher)) {
+	p, err := loadPublisher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emit != nil {
+		emit(p)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkIds(t *testing.T, envelopes []envelope, ids ...string) {
+	t.Helper()
+	if len(envelopes) != len(ids) {
+		t.Fatalf("%d events published, want %d", len(envelopes), len(ids))
+	}
+	for i, e := range envelopes {
+		if e.Id != ids[i] {
+			t.Errorf("event %d is %s, want %s", i, e.Id, ids[i])
+		}
+	}
+}
+
+func TestPublisherPublish(t *testing.T) {
+	url := startNATS(t)
+	path, outboxPath := writeEventsFile(t, url)
+	publishAll(t, path, func(p *publisher) {
+		p.emit("scan.result", "1", balanceEvent{Asset: "ETH", Symbol: "ETH", Decimals: 18, Amount: "1"})
+		p.emit("sweep.planned", "5", sweepEvent{Asset: "ETH", Amount: "1"})
+	})
+	envelopes := published(t, url)
+	if len(envelopes) != 2 || envelopes[0].Type != "scan.result" || envelopes[1].Type != "sweep.planned" || envelopes[1].NetworkId != "5" {
+		t.Fatalf("published %+v", envelopes)
+	}
+	o, err := openOutbox(outboxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if n := o.len(); n != 0 {
+		t.Errorf("%d events left in the outbox", n)
+	}
+}
+
+// TestPublisherReplay checks that the events left in the outbox by a
+// process that could not publish them are published by the next one.
+func TestPublisherReplay(t *testing.T) {
+	url := startNATS(t)
+	path, outboxPath := writeEventsFile(t, url)
+	leaveInOutbox(t, outboxPath, "a", "b")
+	publishAll(t, path, func(p *publisher) {
+		p.emit("sweep.planned", "1", sweepEvent{Asset: "ETH", Amount: "1"})
+	})
+	envelopes := published(t, url)
+	if len(envelopes) != 3 {
+		t.Fatalf("%d events published, want 3", len(envelopes))
+	}
+	checkIds(t, envelopes[:2], "a", "b")
+}
+
+// TestPublisherDedup checks that an event published again, its
+// acknowledgment having been lost, is stored once.
+func TestPublisherDedup(t *testing.T) {
+	url := startNATS(t)
+	path, outboxPath := writeEventsFile(t, url)
+	leaveInOutbox(t, outboxPath, "a")
+	publishAll(t, path, nil)
+	leaveInOutbox(t, outboxPath, "a", "b")
+	publishAll(t, path, nil)
+	checkIds(t, published(t, url), "a", "b")
+}
+
+func TestOutboxLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.outbox")
+	o, err := openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openOutbox(path); err == nil {
+		t.Fatal("outbox opened twice")
+	}
+	o.Close()
+	if o, err = openOutbox(path); err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// EVM opcodes of the sandbox token code.
+const (
+	opSTOP         = 0x00
+	opADD          = 0x01
+	opSUB          = 0x03
+	opDIV          = 0x04
+	opLT           = 0x10
+	opGT           = 0x11
+	opEQ           = 0x14
+	opAND          = 0x16
+	opSHR          = 0x1c
+	opSHA3         = 0x20
+	opCALLER       = 0x33
+	opCALLDATALOAD = 0x35
+	opPOP          = 0x50
+	opMSTORE       = 0x52
+	opSLOAD        = 0x54
+	opSSTORE       = 0x55
+	opJUMP         = 0x56
+	opJUMPI        = 0x57
+	opJUMPDEST     = 0x5b
+	opPUSH1        = 0x60
+	opDUP1         = 0x80
+	opSWAP1        = 0x90
+	opLOG3         = 0xa3
+	opRETURN       = 0xf3
+	opREVERT       = 0xfd
+)
+
+// asmLabel marks a jump destination and asmRef pushes its offset.
+type (
+	asmLabel string
+	asmRef   string
+)
+
+// dup and swap return the DUPn and SWAPn opcodes.
+func dup(n int) byte  { return byte(opDUP1 + n - 1) }
+func swap(n int) byte { return byte(opSWAP1 + n - 1) }
+
+// pushInt returns the immediate of the shortest PUSH of v.
+func pushInt(v int64) []byte {
+	b := big.NewInt(v).Bytes()
+	if len(b) == 0 {
+		b = []byte{0}
+	}
+	return b
+}
+
+// assemble returns the code of prog, a list of opcodes, []byte immediates
+// of PUSH instructions, labels, label references and nested lists.
+func assemble(prog ...interface{}) []byte {
+	labels := make(map[asmLabel]int)
+	var emit func(code []byte, items []interface{}) []byte
+	emit = func(code []byte, items []interface{}) []byte {
+		for _, item := range items {
+			switch item := item.(type) {
+			case byte:
+				code = append(code, item)
+			case int:
+				code = append(code, byte(item))
+			case []byte:
+				if len(item) == 0 || len(item) > 32 {
+					panic(fmt.Sprintf("invalid push of %d bytes", len(item)))
+				}
+				code = append(code, byte(opPUSH1+len(item)-1))
+				code = append(code, item...)
+			case asmLabel:
+				labels[item] = len(code)
+				code = append(code, opJUMPDEST)
+			case asmRef:
+				offset := labels[asmLabel(item)]
+				code = append(code, opPUSH1+1, byte(offset>>8), byte(offset))
+			case []interface{}:
+				code = emit(code, item)
+			default:
+				panic(fmt.Sprintf("invalid instruction %T", item))
+			}
+		}
+		return code
+	}
+	// The first pass finds the labels, the second one resolves them.
+	emit(nil, prog)
+	return emit(nil, prog)
+}
+
+// sandboxToken is a sample ERC20 of the sandbox chain. Balances are
+// stored at keccak256(owner . 1) and allowances at
+// keccak256(owner . spender . 2), the total supply at slot 0.
+type sandboxToken struct {
+	name     string
+	symbol   string
+	decimals uint8
+	// noReturn tokens return nothing from transfer, transferFrom and
+	// approve, like USDT.
+	noReturn bool
+	// fee tokens burn 1% of every transfer.
+	fee bool
+	// bytes32 tokens return their name and symbol as bytes32, like MKR.
+	bytes32 bool
+}
+
+var (
+	transferTopic = fromHex("ddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")
+	approvalTopic = fromHex("8c5be1e5ebec7d5bd14f71427d1e84f3dd0314c0f7b2291e5b200ac8c7c3b925")
+	addressMask   = fromHex("ffffffffffffffffffffffffffffffffffffffff")
+)
+
+func fromHex(s string) []byte {
+	b, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("invalid hex " + s)
+	}
+	return b.FillBytes(make([]byte, len(s)/2))
+}
+
+// code returns the runtime code of t.
+func (t sandboxToken) code() []byte {
+	ret32 := []interface{}{pushInt(0), opMSTORE, pushInt(32), pushInt(0), opRETURN}
+	returnTrue := []interface{}{pushInt(1), ret32}
+	if t.noReturn {
+		returnTrue = []interface{}{opSTOP}
+	}
+	arg := func(i int64) []interface{} {
+		return []interface{}{pushInt(4 + 32*i), opCALLDATALOAD}
+	}
+	address := func(i int64) []interface{} {
+		return []interface{}{arg(i), addressMask, opAND}
+	}
+	// balanceSlot replaces the address on top of the stack with the slot
+	// of its balance.
+	balanceSlot := []interface{}{pushInt(0), opMSTORE, pushInt(1), pushInt(32), opMSTORE, pushInt(64), pushInt(0), opSHA3}
+	// allowanceSlot pushes the slot of the allowance of the owner in
+	// memory 0 to the spender in memory 32.
+	allowanceSlot := []interface{}{pushInt(2), pushInt(64), opMSTORE, pushInt(96), pushInt(0), opSHA3}
+	text := func(s string) []interface{} {
+		data := make([]byte, 32)
+		copy(data, s)
+		if t.bytes32 {
+			return []interface{}{data, pushInt(0), opMSTORE, pushInt(32), pushInt(0), opRETURN}
+		}
+		return []interface{}{
+			pushInt(32), pushInt(0), opMSTORE,
+			pushInt(int64(len(s))), pushInt(32), opMSTORE,
+			data, pushInt(64), opMSTORE,
+			pushInt(96), pushInt(0), opRETURN,
+		}
+	}
+	// logTransfer logs a Transfer of the amount in memory 0, with the
+	// stack holding from and to.
+	logTransfer := []interface{}{transferTopic, pushInt(32), pushInt(0), opLOG3}
+
+	var credit []interface{}
+	if t.fee {
+		// [from, to, amount, ret]
+		credit = []interface{}{
+			pushInt(100), dup(4), opDIV, // fee
+			dup(1), dup(5), opSUB, // received
+			dup(4), balanceSlot, dup(1), opSLOAD, dup(3), opADD, swap(1), opSSTORE,
+			pushInt(0), opSLOAD, dup(3), swap(1), opSUB, pushInt(0), opSSTORE,
+			pushInt(0), opMSTORE, // [fee, from, to, amount, ret]
+			dup(3), dup(3), logTransfer,
+			pushInt(0), opMSTORE, // [from, to, amount, ret]
+			pushInt(0), dup(2), logTransfer,
+		}
+	} else {
+		credit = []interface{}{
+			dup(2), balanceSlot, dup(1), opSLOAD, dup(5), opADD, swap(1), opSSTORE,
+			dup(3), pushInt(0), opMSTORE,
+			dup(2), dup(2), logTransfer,
+		}
+	}
+
+	selector := func(sig string, label asmLabel) []interface{} {
+		return []interface{}{dup(1), fromHex(sig), opEQ, asmRef(label), opJUMPI}
+	}
+	return assemble(
+		pushInt(0), opCALLDATALOAD, pushInt(0xe0), opSHR,
+		selector("06fdde03", "name"),
+		selector("95d89b41", "symbol"),
+		selector("313ce567", "decimals"),
+		selector("18160ddd", "totalSupply"),
+		selector("70a08231", "balanceOf"),
+		selector("a9059cbb", "transfer"),
+		selector("23b872dd", "transferFrom"),
+		selector("095ea7b3", "approve"),
+		selector("dd62ed3e", "allowance"),
+		asmLabel("revert"), pushInt(0), dup(1), opREVERT,
+
+		asmLabel("name"), text(t.name),
+		asmLabel("symbol"), text(t.symbol),
+		asmLabel("decimals"), pushInt(int64(t.decimals)), ret32,
+		asmLabel("totalSupply"), pushInt(0), opSLOAD, ret32,
+		asmLabel("balanceOf"), address(0), balanceSlot, opSLOAD, ret32,
+		asmLabel("allowance"),
+		address(0), pushInt(0), opMSTORE, address(1), pushInt(32), opMSTORE,
+		allowanceSlot, opSLOAD, ret32,
+		asmLabel("approve"),
+		opCALLER, pushInt(0), opMSTORE, address(0), pushInt(32), opMSTORE,
+		arg(1), allowanceSlot, opSSTORE,
+		arg(1), pushInt(0), opMSTORE,
+		address(0), opCALLER, approvalTopic, pushInt(32), pushInt(0), opLOG3,
+		returnTrue,
+		asmLabel("transfer"),
+		asmRef("done"), arg(1), address(0), opCALLER, asmRef("move"), opJUMP,
+		asmLabel("transferFrom"),
+		address(0), pushInt(0), opMSTORE, opCALLER, pushInt(32), opMSTORE,
+		allowanceSlot, dup(1), opSLOAD, arg(2), // [amount, allowance, slot]
+		dup(1), dup(3), opLT, asmRef("revert"), opJUMPI,
+		swap(1), opSUB, swap(1), opSSTORE,
+		asmRef("done"), arg(2), address(1), address(0), asmRef("move"), opJUMP,
+		asmLabel("done"), returnTrue,
+
+		// move moves an amount between balances, with the stack holding
+		// from, to, amount and the return label.
+		asmLabel("move"),
+		dup(1), balanceSlot, dup(1), opSLOAD, // [balance, slot, from, to, amount, ret]
+		dup(1), dup(6), opGT, asmRef("revert"), opJUMPI,
+		dup(5), swap(1), opSUB, swap(1), opSSTORE,
+		credit,
+		opPOP, opPOP, opPOP, opJUMP,
+	)
+}
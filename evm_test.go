@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+)
+
+// tokenChain is a simulated chain holding the sandbox tokens.
+type tokenChain struct {
+	t      *testing.T
+	sim    *simulated.Backend
+	client simulated.Client
+	erc20  abi.ABI
+	// holder owns the tokens and makes the calls.
+	holder common.Address
+}
+
+// newTokenChain starts a chain where holder owns ether and 1000 units of
+// every sandbox token.
+func newTokenChain(t *testing.T, holder common.Address) *tokenChain {
+	alloc := types.GenesisAlloc{holder: {Balance: new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)}}
+	for i, token := range sandboxTokens {
+		amount := common.BigToHash(new(big.Int).Mul(big.NewInt(1000), pow10(uint(token.decimals))))
+		storage := map[common.Hash]common.Hash{tokenBalanceSlot(holder): amount, {}: amount}
+		alloc[sandboxTokenAddress(i)] = types.Account{Code: token.code(), Storage: storage, Balance: new(big.Int)}
+	}
+	sim := simulated.NewBackend(alloc)
+	t.Cleanup(func() { sim.Close() })
+	parsed, err := abi.JSON(strings.NewReader(ERC20ABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tokenChain{t: t, sim: sim, client: sim.Client(), erc20: parsed, holder: holder}
+}
+
+// call runs a method of token from the holder.
+func (c *tokenChain) call(token common.Address, method string, args ...interface{}) ([]byte, error) {
+	data, err := c.erc20.Pack(method, args...)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return c.client.CallContract(context.Background(), ethereum.CallMsg{From: c.holder, To: &token, Data: data}, nil)
+}
+
+func (c *tokenChain) balanceOf(token, owner common.Address) *big.Int {
+	c.t.Helper()
+	out, err := c.call(token, "balanceOf", owner)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return new(big.Int).SetBytes(out)
+}
+
+// send mines a transaction of key calling method of token.
+func (c *tokenChain) send(key *ecdsa.PrivateKey, token common.Address, method string, args ...interface{}) *types.Receipt {
+	c.t.Helper()
+	ctx := context.Background()
+	data, err := c.erc20.Pack(method, args...)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+	nonce, err := c.client.PendingNonceAt(ctx, from)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	gasPrice, err := c.client.SuggestGasPrice(ctx)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	chainId, err := c.client.ChainID(ctx)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	tx, err := types.SignTx(types.NewTransaction(nonce, token, new(big.Int), 200000, gasPrice, data), types.LatestSignerForChainID(chainId), key)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.client.SendTransaction(ctx, tx); err != nil {
+		c.t.Fatal(err)
+	}
+	c.sim.Commit()
+	receipt, err := c.client.TransactionReceipt(ctx, tx.Hash())
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return receipt
+}
+
+func TestSandboxTokens(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder := crypto.PubkeyToAddress(key.PublicKey)
+	to := common.HexToAddress("0x2000000000000000000000000000000000000002")
+	c := newTokenChain(t, holder)
+
+	for i, token := range sandboxTokens {
+		addr := sandboxTokenAddress(i)
+		unit := pow10(uint(token.decimals))
+		units := func(n int64) *big.Int {
+			return new(big.Int).Mul(big.NewInt(n), unit)
+		}
+		if got := c.balanceOf(addr, holder); got.Cmp(units(1000)) != 0 {
+			t.Errorf("%s: balanceOf = %s, want %s", token.symbol, got, units(1000))
+		}
+
+		out, err := c.call(addr, "decimals")
+		if err != nil || new(big.Int).SetBytes(out).Uint64() != uint64(token.decimals) {
+			t.Errorf("%s: decimals = %x, %v, want %d", token.symbol, out, err, token.decimals)
+		}
+		for method, want := range map[string]string{"name": token.name, "symbol": token.symbol} {
+			out, err := c.call(addr, method)
+			if err != nil {
+				t.Fatalf("%s: %s: %v", token.symbol, method, err)
+			}
+			var got string
+			if token.bytes32 {
+				if len(out) != 32 {
+					t.Errorf("%s: %s returned %d bytes, want a bytes32", token.symbol, method, len(out))
+				}
+				got = string(bytes.TrimRight(out, "\x00"))
+			} else {
+				values, err := c.erc20.Methods[method].Outputs.UnpackValues(out)
+				if err != nil {
+					t.Fatalf("%s: %s: %v", token.symbol, method, err)
+				}
+				got = values[0].(string)
+			}
+			if got != want {
+				t.Errorf("%s: %s = %q, want %q", token.symbol, method, got, want)
+			}
+		}
+
+		// The return value of transfer, as seen by a caller.
+		out, err = c.call(addr, "transfer", to, units(100))
+		switch {
+		case err != nil:
+			t.Errorf("%s: transfer: %v", token.symbol, err)
+		case token.noReturn && len(out) != 0:
+			t.Errorf("%s: transfer returned %x, want nothing", token.symbol, out)
+		case !token.noReturn && new(big.Int).SetBytes(out).Cmp(big.NewInt(1)) != 0:
+			t.Errorf("%s: transfer returned %x, want true", token.symbol, out)
+		}
+
+		receipt := c.send(key, addr, "transfer", to, units(100))
+		if receipt.Status != types.ReceiptStatusSuccessful {
+			t.Fatalf("%s: transfer failed", token.symbol)
+		}
+		received := units(100)
+		if token.fee {
+			received = units(99)
+		}
+		if got := c.balanceOf(addr, to); got.Cmp(received) != 0 {
+			t.Errorf("%s: received %s, want %s", token.symbol, got, received)
+		}
+		if got := c.balanceOf(addr, holder); got.Cmp(units(900)) != 0 {
+			t.Errorf("%s: holder has %s, want %s", token.symbol, got, units(900))
+		}
+		if _, err := c.call(addr, "transfer", to, units(1000)); err == nil {
+			t.Errorf("%s: transfer above the balance did not revert", token.symbol)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// ForwarderABI is the ABI of the Forwarder contract of forwarder.sol.
+const ForwarderABI = `[{"inputs":[],"name":"parent","outputs":[{"name":"","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"flush","outputs":[],"stateMutability":"nonpayable","type":"function"},{"inputs":[{"name":"token","type":"address"}],"name":"flushTokens","outputs":[],"stateMutability":"nonpayable","type":"function"}]`
+
+// ForwarderFactoryABI is the ABI of the ForwarderFactory contract of
+// forwarder.sol.
+const ForwarderFactoryABI = `[{"inputs":[],"name":"parent","outputs":[{"name":"","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"initCodeHash","outputs":[{"name":"","type":"bytes32"}],"stateMutability":"view","type":"function"},{"inputs":[{"name":"salt","type":"bytes32"}],"name":"createForwarder","outputs":[{"name":"forwarder","type":"address"}],"stateMutability":"nonpayable","type":"function"},{"inputs":[{"name":"salt","type":"bytes32"},{"name":"tokens","type":"address[]"}],"name":"createAndFlush","outputs":[{"name":"forwarder","type":"address"}],"stateMutability":"nonpayable","type":"function"}]`
+
+// forwarderAddress returns the CREATE2 address of the forwarder of salt.
+func forwarderAddress(factory common.Address, salt [32]byte, initCodeHash common.Hash) common.Address {
+	return crypto.CreateAddress2(factory, salt, initCodeHash.Bytes())
+}
+
+// parseSalt parses a hex bytes32 or a decimal salt.
+func parseSalt(s string) ([32]byte, error) {
+	var salt [32]byte
+	if strings.HasPrefix(s, "0x") {
+		b := common.FromHex(s)
+		if len(b) > 32 {
+			return salt, fmt.Errorf("invalid salt %q", s)
+		}
+		copy(salt[32-len(b):], b)
+		return salt, nil
+	}
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok || n.Sign() < 0 || n.BitLen() > 256 {
+		return salt, fmt.Errorf("invalid salt %q", s)
+	}
+	n.FillBytes(salt[:])
+	return salt, nil
+}
+
+// checkForwarderFactory checks that the factory of every chain derives its
+// forwarders from --forwarder-init-code-hash, so that the scanned addresses
+// are the ones it deploys, and, when parent is set, that it flushes them to
+// parent.
+func checkForwarderFactory(ctx context.Context, chains []*chain, parent *common.Address) error {
+	addr := common.HexToAddress(opts.ForwarderFactory)
+	initCodeHash := common.HexToHash(opts.ForwarderInitCodeHash)
+	callOpts := &bind.CallOpts{Context: ctx}
+	for _, ch := range chains {
+		factory, err := boundContract(ch, addr, ForwarderFactoryABI)
+		if err != nil {
+			return err
+		}
+		var hash [32]byte
+		if err := factory.Call(callOpts, &hash, "initCodeHash"); err != nil {
+			return fmt.Errorf("forwarder factory %s on network %s: %v", addr.Hex(), ch.networkId, redactError(err, ch.url))
+		}
+		if hash != initCodeHash {
+			return fmt.Errorf("forwarder factory %s on network %s: init code hash is %s, not the --forwarder-init-code-hash %s",
+				addr.Hex(), ch.networkId, common.Hash(hash).Hex(), initCodeHash.Hex())
+		}
+		if parent == nil {
+			continue
+		}
+		var to common.Address
+		if err := factory.Call(callOpts, &to, "parent"); err != nil {
+			return fmt.Errorf("forwarder factory %s on network %s: %v", addr.Hex(), ch.networkId, redactError(err, ch.url))
+		}
+		if to != *parent {
+			return fmt.Errorf("forwarder factory %s on network %s: flushes to %s, not to the swipe address %s",
+				addr.Hex(), ch.networkId, to.Hex(), parent.Hex())
+		}
+		if err := screen.checkDestination(to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamForwarders sends the forwarder of every salt of the --forwarder-salts
+// files to accounts, once the factory is checked on chains.
+func streamForwarders(ctx context.Context, chains []*chain, accounts chan<- account) error {
+	if len(opts.ForwarderSalts) == 0 {
+		return nil
+	}
+	if opts.ForwarderFactory == "" || opts.ForwarderInitCodeHash == "" {
+		return fmt.Errorf("--forwarder-salts needs --forwarder-factory and --forwarder-init-code-hash")
+	}
+	if err := checkForwarderFactory(ctx, chains, nil); err != nil {
+		return err
+	}
+	factory := common.HexToAddress(opts.ForwarderFactory)
+	initCodeHash := common.HexToHash(opts.ForwarderInitCodeHash)
+	for _, path := range opts.ForwarderSalts {
+		f, err := openFile(path)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		line := 0
+		for scanner.Scan() {
+			line++
+			str := strings.TrimSpace(scanner.Text())
+			if str == "" || strings.HasPrefix(str, "#") {
+				continue
+			}
+			salt, err := parseSalt(str)
+			if err != nil {
+				f.Close()
+				return fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			acc := account{address: forwarderAddress(factory, salt, initCodeHash), salt: &salt}
+			select {
+			case accounts <- acc:
+			case <-ctx.Done():
+				f.Close()
+				return ctx.Err()
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// operatorMu serializes the transactions of the forwarder operator key.
+var operatorMu sync.Mutex
+
+// SwipeForwarder flushes the tokens and the ether of the forwarder of salt
+// to its parent with transactions of the operator key. An undeployed
+// forwarder is deployed and flushed in a single call to the factory.
+func SwipeForwarder(ctx context.Context, ch *chain, operator *ecdsa.PrivateKey, addr common.Address, salt [32]byte, tokens []tokenBalance, value *big.Int) error {
+	operatorMu.Lock()
+	defer operatorMu.Unlock()
+	if err := halted(); err != nil {
+		return err
+	}
+
+	code, err := ch.client.CodeAt(ctx, addr, nil)
+	if err != nil {
+		return err
+	}
+	auth := bind.NewKeyedTransactor(operator)
+	auth.Context = ctx
+	from := crypto.PubkeyToAddress(operator.PublicKey)
+	record := func(action, method string, hash common.Hash, err error) {
+		data := map[string]string{"network_id": ch.networkId.String(), "from": from.Hex(), "forwarder": addr.Hex(), "call": method}
+		if err != nil {
+			data["error"] = redactError(err, ch.url).Error()
+		} else {
+			data["tx"] = hash.Hex()
+		}
+		audit(action, data)
+	}
+
+	if len(code) == 0 {
+		parsed, err := abi.JSON(strings.NewReader(ForwarderFactoryABI))
+		if err != nil {
+			return err
+		}
+		factory := bind.NewBoundContract(common.HexToAddress(opts.ForwarderFactory), parsed, ch.client, ch.client, ch.client)
+		var list []common.Address
+		for _, t := range tokens {
+			list = append(list, t.token)
+		}
+		tx, err := factory.Transact(auth, "createAndFlush", salt, list)
+		if err != nil {
+			record("broadcast", "createAndFlush", common.Hash{}, err)
+			return err
+		}
+		record("broadcast", "createAndFlush", tx.Hash(), nil)
+		for _, t := range tokens {
+			recordSweep(ch, addr, t.token.Hex(), tx.Hash())
+		}
+		if value != nil && value.Sign() != 0 {
+			recordSweep(ch, addr, "ETH", tx.Hash())
+		}
+		log.Printf("Deploying and flushing forwarder %s [%s]", addr.Hex(), tx.Hash().Hex())
+		return nil
+	}
+
+	parsed, err := abi.JSON(strings.NewReader(ForwarderABI))
+	if err != nil {
+		return err
+	}
+	forwarder := bind.NewBoundContract(addr, parsed, ch.client, ch.client, ch.client)
+	for _, t := range tokens {
+		tx, err := forwarder.Transact(auth, "flushTokens", t.token)
+		if err != nil {
+			record("broadcast", "flushTokens", common.Hash{}, err)
+			return err
+		}
+		record("broadcast", "flushTokens", tx.Hash(), nil)
+		recordSweep(ch, addr, t.token.Hex(), tx.Hash())
+		log.Printf("Flushing %s of forwarder %s [%s]", t.token.Hex(), addr.Hex(), tx.Hash().Hex())
+	}
+	if value != nil && value.Sign() != 0 {
+		tx, err := forwarder.Transact(auth, "flush")
+		if err != nil {
+			record("broadcast", "flush", common.Hash{}, err)
+			return err
+		}
+		record("broadcast", "flush", tx.Hash(), nil)
+		recordSweep(ch, addr, "ETH", tx.Hash())
+		log.Printf("Flushing ether of forwarder %s [%s]", addr.Hex(), tx.Hash().Hex())
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+pragma solidity ^0.5.3;
+
+// Forwarder sends the ether and the tokens it holds to its parent. Anyone
+// may flush it since the funds can only go to the parent.
+contract Forwarder {
+    address payable public parent;
+
+    constructor(address payable _parent) public {
+        parent = _parent;
+    }
+
+    function() external payable {}
+
+    function flush() public {
+        (bool ok, ) = parent.call.value(address(this).balance)("");
+        require(ok, "flush failed");
+    }
+
+    // flushTokens also accepts the tokens whose transfer returns nothing.
+    function flushTokens(address token) public {
+        (bool ok, bytes memory data) = token.staticcall(abi.encodeWithSelector(0x70a08231, address(this)));
+        require(ok && data.length >= 32, "balanceOf failed");
+        uint256 balance = abi.decode(data, (uint256));
+        if (balance == 0) {
+            return;
+        }
+        (ok, data) = token.call(abi.encodeWithSelector(0xa9059cbb, parent, balance));
+        require(ok && (data.length == 0 || abi.decode(data, (bool))), "transfer failed");
+    }
+}
+
+// ForwarderFactory deploys forwarders with CREATE2, at addresses derived from
+// the factory, the salt and the forwarder init code: the Forwarder creation
+// code followed by the ABI encoded parent. initCodeHash returns the hash
+// --forwarder-init-code-hash expects.
+contract ForwarderFactory {
+    address payable public parent;
+
+    constructor(address payable _parent) public {
+        parent = _parent;
+    }
+
+    function initCodeHash() public view returns (bytes32) {
+        return keccak256(initCode());
+    }
+
+    function createForwarder(bytes32 salt) public returns (address forwarder) {
+        bytes memory code = initCode();
+        assembly {
+            forwarder := create2(0, add(code, 32), mload(code), salt)
+        }
+        require(forwarder != address(0), "create2 failed");
+    }
+
+    function createAndFlush(bytes32 salt, address[] memory tokens) public returns (address forwarder) {
+        forwarder = createForwarder(salt);
+        Forwarder f = Forwarder(address(uint160(forwarder)));
+        for (uint256 i = 0; i < tokens.length; i++) {
+            f.flushTokens(tokens[i]);
+        }
+        f.flush();
+    }
+
+    function initCode() internal view returns (bytes memory) {
+        return abi.encodePacked(type(Forwarder).creationCode, abi.encode(parent));
+    }
+}
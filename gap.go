@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// isUsed reports whether addr has a nonce, an ether balance or a balance of
+// one of contractAddresses on any chain.
+func isUsed(ctx context.Context, chains []*chain, addr common.Address, contractAddresses []common.Address) (bool, error) {
+	for _, ch := range chains {
+		nonce, err := ch.client.NonceAt(ctx, addr, nil)
+		if err != nil {
+			return false, err
+		}
+		if nonce != 0 {
+			return true, nil
+		}
+		bal, err := ch.client.BalanceAt(ctx, addr, nil)
+		if err != nil {
+			return false, err
+		}
+		if bal.Cmp(&big.Int{}) != 0 {
+			return true, nil
+		}
+		for _, contractAddr := range contractAddresses {
+			erc20, err := NewERC20Caller(contractAddr, ch.client)
+			if err != nil {
+				return false, err
+			}
+			bal, err := erc20.BalanceOf(&bind.CallOpts{Context: ctx}, addr)
+			if err != nil {
+				continue
+			}
+			if bal.Cmp(&big.Int{}) != 0 {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// parseTemplate splits a path template such as m/44'/60'/0'/0/* around its
+// walked index. The index is hardened when written *'. A template without *
+// walks the children of the path.
+func parseTemplate(template string) (prefix []uint32, offset uint32, suffix []uint32, err error) {
+	before, after := template, ""
+	if i := strings.Index(template, "*"); i >= 0 {
+		before, after = template[:i], template[i+1:]
+		if strings.HasPrefix(after, "'") || strings.HasPrefix(after, "h") {
+			offset, after = hardened, after[1:]
+		}
+		if strings.Contains(after, "*") {
+			return nil, 0, nil, fmt.Errorf("invalid path %q: more than one *", template)
+		}
+	}
+	if prefix, err = parsePath(before); err != nil {
+		return nil, 0, nil, err
+	}
+	if suffix, err = parsePath(after); err != nil {
+		return nil, 0, nil, err
+	}
+	return prefix, offset, suffix, nil
+}
+
+// walkGap derives the accounts of root at template until gapLimit
+// consecutive unused addresses are found, sending every used one to
+// accounts. It returns the highest used index, or -1 if none was.
+func walkGap(ctx context.Context, chains []*chain, root *extendedKey, template string, gapLimit uint, contractAddresses []common.Address, accounts chan<- account) (int64, error) {
+	prefix, offset, suffix, err := parseTemplate(template)
+	if err != nil {
+		return -1, err
+	}
+	parent, err := root.derive(prefix)
+	if err != nil {
+		return -1, err
+	}
+	highest := int64(-1)
+	for i, gap := uint32(0), uint(0); gap < gapLimit && i < hardened; i++ {
+		child, err := parent.child(i + offset)
+		if err == nil {
+			child, err = child.derive(suffix)
+		}
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		acc := account{address: child.address()}
+		used, err := isUsed(ctx, chains, acc.address, contractAddresses)
+		if err != nil {
+			return highest, err
+		}
+		if !used {
+			gap++
+			continue
+		}
+		gap = 0
+		highest = int64(i)
+		if child.priv != nil {
+			if acc.key, err = child.privateKey(); err != nil {
+				return highest, err
+			}
+		}
+		select {
+		case accounts <- acc:
+		case <-ctx.Done():
+			return highest, ctx.Err()
+		}
+	}
+	return highest, nil
+}
+
+// logHighest logs the highest used index of a walked path.
+func logHighest(path string, highest int64) {
+	if highest < 0 {
+		log.Printf("Path %s: no used index", path)
+	} else {
+		log.Printf("Path %s: highest used index %d", path, highest)
+	}
+}
+
+// streamMnemonic walks every --hd-path of the mnemonic and logs the highest
+// used index of each.
+func streamMnemonic(ctx context.Context, chains []*chain, contractAddresses []common.Address, accounts chan<- account) error {
+	root, err := newMasterKey(mnemonicSeed(opts.Mnemonic, opts.MnemonicPassphrase))
+	if err != nil {
+		return err
+	}
+	for _, path := range opts.HDPaths {
+		highest, err := walkGap(ctx, chains, root, path, opts.GapLimit, contractAddresses, accounts)
+		if err != nil {
+			return err
+		}
+		logHighest(path, highest)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// hardened is the offset of BIP-32 hardened child indices.
+const hardened = uint32(0x80000000)
+
+// extendedKey is a BIP-32 node, private when priv is set.
+type extendedKey struct {
+	priv      *big.Int
+	x, y      *big.Int
+	chainCode []byte
+}
+
+// mnemonicSeed returns the BIP-39 seed of mnemonic.
+func mnemonicSeed(mnemonic, passphrase string) []byte {
+	mnemonic = strings.Join(strings.Fields(mnemonic), " ")
+	return pbkdf2.Key([]byte(mnemonic), []byte("mnemonic"+passphrase), 2048, 64, sha512.New)
+}
+
+// newMasterKey returns the BIP-32 master key of seed.
+func newMasterKey(seed []byte) (*extendedKey, error) {
+	mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+	priv := new(big.Int).SetBytes(sum[:32])
+	if priv.Sign() == 0 || priv.Cmp(crypto.S256().Params().N) >= 0 {
+		return nil, errors.New("invalid master key")
+	}
+	x, y := crypto.S256().ScalarBaseMult(sum[:32])
+	return &extendedKey{priv: priv, x: x, y: y, chainCode: sum[32:]}, nil
+}
+
+// pubBytes returns the compressed public key of k.
+func (k *extendedKey) pubBytes() []byte {
+	b := make([]byte, 33)
+	b[0] = 2 + byte(k.y.Bit(0))
+	k.x.FillBytes(b[1:])
+	return b
+}
+
+// child derives the child i of k. Hardened children need a private key.
+func (k *extendedKey) child(i uint32) (*extendedKey, error) {
+	var data []byte
+	if i >= hardened {
+		if k.priv == nil {
+			return nil, errors.New("hardened derivation from a public key")
+		}
+		data = append([]byte{0}, k.priv.FillBytes(make([]byte, 32))...)
+	} else {
+		data = k.pubBytes()
+	}
+	data = binary.BigEndian.AppendUint32(data, i)
+
+	mac := hmac.New(sha512.New, k.chainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+
+	curve := crypto.S256()
+	n := curve.Params().N
+	il := new(big.Int).SetBytes(sum[:32])
+	if il.Cmp(n) >= 0 {
+		return nil, fmt.Errorf("invalid child %d", i)
+	}
+	child := &extendedKey{chainCode: sum[32:]}
+	if k.priv != nil {
+		child.priv = il.Add(il, k.priv)
+		child.priv.Mod(child.priv, n)
+		if child.priv.Sign() == 0 {
+			return nil, fmt.Errorf("invalid child %d", i)
+		}
+		child.x, child.y = curve.ScalarBaseMult(child.priv.FillBytes(make([]byte, 32)))
+	} else {
+		x, y := curve.ScalarBaseMult(sum[:32])
+		child.x, child.y = curve.Add(x, y, k.x, k.y)
+		if child.x.Sign() == 0 && child.y.Sign() == 0 {
+			return nil, fmt.Errorf("invalid child %d", i)
+		}
+	}
+	return child, nil
+}
+
+// derive walks path from k.
+func (k *extendedKey) derive(path []uint32) (*extendedKey, error) {
+	var err error
+	for _, i := range path {
+		if k, err = k.child(i); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// address returns the Ethereum address of k.
+func (k *extendedKey) address() common.Address {
+	return crypto.PubkeyToAddress(ecdsa.PublicKey{Curve: crypto.S256(), X: k.x, Y: k.y})
+}
+
+// privateKey returns the private key of k.
+func (k *extendedKey) privateKey() (*ecdsa.PrivateKey, error) {
+	if k.priv == nil {
+		return nil, errors.New("watch-only key")
+	}
+	return crypto.ToECDSA(k.priv.FillBytes(make([]byte, 32)))
+}
+
+// parsePath parses a derivation path such as m/44'/60'/0'/0.
+func parsePath(s string) ([]uint32, error) {
+	parts := strings.Split(strings.TrimSpace(s), "/")
+	if len(parts) > 0 && parts[0] == "m" {
+		parts = parts[1:]
+	}
+	var path []uint32
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+		var offset uint32
+		if strings.HasSuffix(part, "'") || strings.HasSuffix(part, "h") {
+			offset = hardened
+			part = part[:len(part)-1]
+		}
+		i, err := strconv.ParseUint(part, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %q: %v", s, err)
+		}
+		path = append(path, uint32(i)+offset)
+	}
+	return path, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// killState is the content of the --kill-switch sentinel file. A file that
+// is not JSON, such as one created with touch, engages the switch too.
+type killState struct {
+	By     string    `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+	Via    string    `json:"via"`
+	Time   time.Time `json:"time"`
+}
+
+// killSwitchState returns who engaged the kill switch and when, nil when it
+// is released.
+func killSwitchState() (*killState, error) {
+	if opts.KillSwitch == "" {
+		return nil, nil
+	}
+	fi, err := os.Stat(opts.KillSwitch)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	st := &killState{By: "unknown", Via: "sentinel file", Time: fi.ModTime()}
+	if data, err := readFile(opts.KillSwitch); err == nil && len(data) > 0 {
+		if err := json.Unmarshal(data, st); err != nil {
+			st.Reason = strings.TrimSpace(string(data))
+		}
+	}
+	return st, nil
+}
+
+// halted returns an error when the kill switch is engaged, or can not be
+// read, and nothing may be signed.
+func halted() error {
+	st, err := killSwitchState()
+	if err != nil {
+		return fmt.Errorf("kill switch: %v", err)
+	}
+	if st != nil {
+		return fmt.Errorf("kill switch engaged by %s at %s", st.By, st.Time.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// engageKillSwitch writes the sentinel file.
+func engageKillSwitch(by, reason, via string) error {
+	st := &killState{By: by, Reason: reason, Via: via, Time: time.Now().UTC()}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(opts.KillSwitch, data); err != nil {
+		return err
+	}
+	audit("kill switch", map[string]string{"state": "engaged", "by": by, "reason": reason, "via": via})
+	log.Printf("Kill switch engaged by %s via %s: %s", by, via, reason)
+	return nil
+}
+
+// releaseKillSwitch removes the sentinel file.
+func releaseKillSwitch(by, via string) error {
+	if err := os.Remove(opts.KillSwitch); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	audit("kill switch", map[string]string{"state": "released", "by": by, "via": via})
+	log.Printf("Kill switch released by %s via %s", by, via)
+	return nil
+}
+
+// watchKillSwitchSignals engages the kill switch on SIGUSR1 and releases
+// it on SIGUSR2.
+func watchKillSwitchSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigs {
+			by := fmt.Sprintf("signal to pid %d", os.Getpid())
+			var err error
+			if sig == syscall.SIGUSR1 {
+				err = engageKillSwitch(by, "", "signal "+sig.String())
+			} else {
+				err = releaseKillSwitch(by, "signal "+sig.String())
+			}
+			if err != nil {
+				log.Printf("Kill switch: %v", err)
+			}
+		}
+	}()
+}
+
+// killSwitchHandler serves the kill switch state on GET and engages or
+// releases it on POST of {"by": …, "reason": …} to /engage and /release,
+// authenticated with a bearer token.
+func killSwitchHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			By     string `json:"by"`
+			Reason string `json:"reason"`
+		}
+		if r.Method == http.MethodPost {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.By == "" {
+				http.Error(w, `expected {"by": "...", "reason": "..."}`, http.StatusBadRequest)
+				return
+			}
+		}
+		via := "http from " + r.RemoteAddr
+		var err error
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/kill-switch":
+		case r.Method == http.MethodPost && r.URL.Path == "/kill-switch/engage":
+			err = engageKillSwitch(req.By, req.Reason, via)
+		case r.Method == http.MethodPost && r.URL.Path == "/kill-switch/release":
+			err = releaseKillSwitch(req.By, via)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		st, err := killSwitchState()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"engaged": st != nil, "state": st})
+	})
+}
+
+// serveKillSwitch serves killSwitchHandler on addr, which must be a
+// loopback address.
+func serveKillSwitch(addr, token string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("kill switch must listen on a loopback address, not %s", addr)
+	}
+	if token == "" {
+		return fmt.Errorf("no kill switch token, use --kill-switch-token")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Kill switch listening on %s", addr)
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go http.Serve(l, killSwitchHandler(token))
+	return nil
+}
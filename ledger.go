@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ledgerEntry is a line of the crediting ledger. Credits are identified by
+// the transaction hash and log index of the deposit, -1 for ether.
+type ledgerEntry struct {
+	// Kind is credit, reversal, sweep or cursor.
+	Kind      string         `json:"kind"`
+	Id        string         `json:"id,omitempty"`
+	NetworkId string         `json:"network_id"`
+	Customer  string         `json:"customer,omitempty"`
+	Account   common.Address `json:"account"`
+	From      common.Address `json:"from"`
+	Asset     string         `json:"asset,omitempty"`
+	Amount    string         `json:"amount,omitempty"`
+	TxHash    common.Hash    `json:"tx_hash"`
+	LogIndex  int            `json:"log_index"`
+	Block     uint64         `json:"block"`
+	BlockHash common.Hash    `json:"block_hash"`
+	Time      time.Time      `json:"time"`
+	// Screening describes why a credit was flagged.
+	Screening string `json:"screening,omitempty"`
+	// Deposits are the credits consolidated by a sweep.
+	Deposits []string `json:"deposits,omitempty"`
+}
+
+func depositId(tx common.Hash, logIndex int) string {
+	return fmt.Sprintf("%s:%d", tx.Hex(), logIndex)
+}
+
+// unswept identifies the credits of an asset of an account not swept yet.
+type unswept struct {
+	networkId string
+	account   common.Address
+	asset     string
+}
+
+// depositLedger is an append-only ledger of credited deposits and of the
+// sweeps consolidating them.
+type depositLedger struct {
+	mu      sync.Mutex
+	f       *os.File
+	credits map[string]*ledgerEntry
+	cursors map[string]*ledgerEntry
+	pending map[unswept][]string
+}
+
+// ledger is the crediting ledger of the process, nil when disabled.
+var ledger *depositLedger
+
+// openLedger loads the ledger at path and opens it for appending.
+func openLedger(path string) (*depositLedger, error) {
+	l := &depositLedger{
+		credits: make(map[string]*ledgerEntry),
+		cursors: make(map[string]*ledgerEntry),
+		pending: make(map[unswept][]string),
+	}
+	if r, err := openFile(path); err == nil {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+		n := 0
+		for scanner.Scan() {
+			n++
+			line, err := openLine(scanner.Bytes())
+			if err != nil {
+				r.Close()
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			var e ledgerEntry
+			if err := json.Unmarshal(line, &e); err != nil {
+				r.Close()
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			l.apply(&e)
+		}
+		err = scanner.Err()
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l.f = f
+	return l, nil
+}
+
+// apply updates the in memory state of l with e.
+func (l *depositLedger) apply(e *ledgerEntry) {
+	key := unswept{networkId: e.NetworkId, account: e.Account, asset: e.Asset}
+	switch e.Kind {
+	case "credit":
+		l.credits[e.Id] = e
+		l.pending[key] = append(l.pending[key], e.Id)
+	case "reversal":
+		delete(l.credits, e.Id)
+		ids := l.pending[key][:0]
+		for _, id := range l.pending[key] {
+			if id != e.Id {
+				ids = append(ids, id)
+			}
+		}
+		l.pending[key] = ids
+	case "sweep":
+		delete(l.pending, key)
+	case "cursor":
+		l.cursors[e.NetworkId] = e
+	}
+}
+
+// append writes e to the ledger and applies it.
+func (l *depositLedger) append(e *ledgerEntry) error {
+	e.Time = time.Now().UTC()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if line, err = sealLine(line); err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.apply(e)
+	return nil
+}
+
+// credit records a confirmed deposit. It returns false if the deposit was
+// already credited.
+func (l *depositLedger) credit(e *ledgerEntry) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.Kind = "credit"
+	e.Id = depositId(e.TxHash, e.LogIndex)
+	if _, ok := l.credits[e.Id]; ok {
+		return false, nil
+	}
+	return true, l.append(e)
+}
+
+// isCredited reports whether the deposit id is credited.
+func (l *depositLedger) isCredited(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.credits[id]
+	return ok
+}
+
+// reverse records that a credited deposit left the canonical chain.
+func (l *depositLedger) reverse(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.credits[id]
+	if !ok {
+		return nil
+	}
+	r := *c
+	r.Kind = "reversal"
+	return l.append(&r)
+}
+
+// cursor returns the last block processed on networkId, nil if none.
+func (l *depositLedger) cursor(networkId string) *ledgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cursors[networkId]
+}
+
+func (l *depositLedger) setCursor(networkId string, block uint64, blockHash common.Hash) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.append(&ledgerEntry{Kind: "cursor", NetworkId: networkId, Block: block, BlockHash: blockHash, LogIndex: -1})
+}
+
+// creditsSince returns the credits of networkId from block on.
+func (l *depositLedger) creditsSince(networkId string, block uint64) []ledgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var entries []ledgerEntry
+	for _, e := range l.credits {
+		if e.NetworkId == networkId && e.Block >= block {
+			entries = append(entries, *e)
+		}
+	}
+	return entries
+}
+
+// linkSweep records the sweep of asset of account by tx, linking it to the
+// credits it consolidates.
+func (l *depositLedger) linkSweep(networkId string, account common.Address, asset string, tx common.Hash) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := unswept{networkId: networkId, account: account, asset: asset}
+	return l.append(&ledgerEntry{
+		Kind:      "sweep",
+		NetworkId: networkId,
+		Account:   account,
+		Asset:     asset,
+		TxHash:    tx,
+		LogIndex:  -1,
+		Deposits:  append([]string{}, l.pending[key]...),
+	})
+}
+
+// recordSweep stores a sweep in the results database, publishes it and
+// links it in the ledger if enabled. A failure to link is fatal, like for
+// the audit log.
+func recordSweep(ch *chain, account common.Address, asset string, tx common.Hash) {
+	networkId := ch.networkId.String()
+	recordTransaction(networkId, account, "sweep", asset, tx)
+	publishBroadcast(ch, account, asset, tx)
+	if ledger == nil || tx == (common.Hash{}) {
+		return
+	}
+	check(ledger.linkSweep(networkId, account, asset, tx))
+}
+
+func (l *depositLedger) Close() error {
+	return l.f.Close()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func testCredit(tx byte, logIndex int, block uint64) *ledgerEntry {
+	return &ledgerEntry{
+		NetworkId: "1",
+		Account:   common.HexToAddress("0x01"),
+		Asset:     "ETH",
+		Amount:    "1",
+		TxHash:    common.Hash{tx},
+		LogIndex:  logIndex,
+		Block:     block,
+	}
+}
+
+// readLedger returns the entries of the plaintext ledger at path.
+func readLedger(t *testing.T, path string) []ledgerEntry {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []ledgerEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e ledgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestLedgerCreditReversal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l, err := openLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		e    *ledgerEntry
+		want bool
+	}{
+		{testCredit(1, -1, 10), true},
+		{testCredit(2, 0, 11), true},
+		{testCredit(2, 1, 11), true},
+		// A deposit seen again, on a restart or a rescan, is credited once.
+		{testCredit(1, -1, 10), false},
+	} {
+		if ok, err := l.credit(c.e); err != nil || ok != c.want {
+			t.Fatalf("credit %s = %v, %v, want %v", c.e.Id, ok, err, c.want)
+		}
+	}
+	reorged := depositId(common.Hash{2}, 0)
+	if err := l.reverse(reorged); err != nil {
+		t.Fatal(err)
+	}
+	// Reversing a deposit not credited records nothing.
+	if err := l.reverse(depositId(common.Hash{3}, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if l.isCredited(reorged) {
+		t.Errorf("%s credited after its reversal", reorged)
+	}
+	if got := len(l.creditsSince("1", 11)); got != 1 {
+		t.Errorf("%d credits since block 11, want 1", got)
+	}
+	if err := l.setCursor("1", 12, common.Hash{12}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// The state is replayed on open.
+	if l, err = openLedger(path); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.isCredited(reorged) || !l.isCredited(depositId(common.Hash{1}, -1)) {
+		t.Error("credits not replayed")
+	}
+	if c := l.cursor("1"); c == nil || c.Block != 12 || c.BlockHash != (common.Hash{12}) {
+		t.Errorf("cursor = %+v, want block 12", c)
+	}
+	// The deposit mined again in another block is credited again.
+	if ok, err := l.credit(testCredit(2, 0, 13)); err != nil || !ok {
+		t.Fatalf("credit after reversal = %v, %v", ok, err)
+	}
+
+	// A sweep consolidates the credits of its asset not yet swept.
+	tx := common.Hash{0xff}
+	if err := l.linkSweep("1", common.HexToAddress("0x01"), "ETH", tx); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.pending[unswept{"1", common.HexToAddress("0x01"), "ETH"}]; len(got) != 0 {
+		t.Errorf("pending after the sweep: %v", got)
+	}
+	if err := l.linkSweep("1", common.HexToAddress("0x01"), "ETH", tx); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readLedger(t, path)
+	var kinds []string
+	for _, e := range entries {
+		kinds = append(kinds, e.Kind)
+	}
+	wantKinds := []string{"credit", "credit", "credit", "reversal", "cursor", "credit", "sweep", "sweep"}
+	if !reflect.DeepEqual(kinds, wantKinds) {
+		t.Fatalf("ledger %v, want %v", kinds, wantKinds)
+	}
+	want := []string{depositId(common.Hash{1}, -1), depositId(common.Hash{2}, 1), reorged}
+	if got := entries[6].Deposits; !reflect.DeepEqual(got, want) {
+		t.Errorf("sweep deposits %v, want %v", got, want)
+	}
+	if got := entries[7].Deposits; len(got) != 0 {
+		t.Errorf("second sweep deposits %v, want none", got)
+	}
+}
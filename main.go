@@ -3,14 +3,13 @@ package main
 import (
 	"context"
 	"crypto/ecdsa"
-	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"math"
 	"math/big"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
@@ -23,38 +22,95 @@ import (
 )
 
 var opts struct {
-	RPCURLs           []string `env:"RPC_URL" long:"rpc-url" required:"true" description:"Ethereum clients urls"`
-	ContractAddresses []string `env:"CONTRACT_ADDRESS" long:"contract-address" description:"ERC20 contracts addresses"`
-	PrivateKeys       []string `env:"PRIVATE_KEY" long:"private-key" required:"true" description:"Base64URL encoded private keys"`
-	SwipeAddress      string   `env:"SWIPE_ADDRESS" long:"swipe-address" description:"Swipe address"`
+	RPCURLs               []string `env:"RPC_URL" env-delim:"," long:"rpc-url" description:"Ethereum clients urls"`
+	ContractAddresses     []string `env:"CONTRACT_ADDRESS" env-delim:"," long:"contract-address" description:"ERC20 contracts addresses"`
+	PrivateKeys           []string `env:"PRIVATE_KEY" env-delim:"," long:"private-key" description:"Base64URL encoded private keys"`
+	KeyFiles              []string `env:"KEY_FILE" env-delim:"," long:"key-file" description:"Files of Base64URL encoded private keys, one per line (- for stdin)"`
+	Mnemonic              string   `env:"MNEMONIC" long:"mnemonic" description:"BIP-39 mnemonic to derive keys from"`
+	MnemonicPassphrase    string   `env:"MNEMONIC_PASSPHRASE" long:"mnemonic-passphrase" description:"BIP-39 passphrase of the mnemonic"`
+	HDPaths               []string `env:"HD_PATH" env-delim:"," long:"hd-path" default:"m/44'/60'/0'/0/*" description:"Derivation path templates, * is walked from index 0"`
+	XPubs                 []string `env:"XPUB" env-delim:"," long:"xpub" description:"Extended public keys to derive watch-only addresses from"`
+	XPubPath              string   `env:"XPUB_PATH" long:"xpub-path" default:"0/*" description:"Non-hardened path template walked from each xpub"`
+	GapLimit              uint     `env:"GAP_LIMIT" long:"gap-limit" default:"20" description:"Stop walking a path after N consecutive unused addresses"`
+	SmartAccounts         []string `env:"SMART_ACCOUNT" env-delim:"," long:"smart-account" description:"ERC-4337 smart accounts as address:owner key, the key Base64URL encoded"`
+	BundlerURLs           []string `env:"BUNDLER_URL" env-delim:"," long:"bundler-url" description:"ERC-4337 bundler urls, prefixed with network id= to restrict to one network"`
+	PaymasterURLs         []string `env:"PAYMASTER_URL" env-delim:"," long:"paymaster-url" description:"Paymaster urls sponsoring the smart account sweeps, prefixed with network id= to restrict to one network"`
+	EntryPoint            string   `env:"ENTRY_POINT" long:"entry-point" default:"0x5FF137D4b0FDCD49DcA30c7CF57E578a026d2789" description:"ERC-4337 v0.6 EntryPoint address"`
+	ForwarderFactory      string   `env:"FORWARDER_FACTORY" long:"forwarder-factory" description:"CREATE2 factory of the forwarder deposit addresses"`
+	ForwarderInitCodeHash string   `env:"FORWARDER_INIT_CODE_HASH" long:"forwarder-init-code-hash" description:"Keccak256 hash of the forwarder init code"`
+	ForwarderSalts        []string `env:"FORWARDER_SALTS" env-delim:"," long:"forwarder-salts" description:"Files of forwarder salts, one hex bytes32 or decimal per line"`
+	ForwarderOperator     string   `env:"FORWARDER_OPERATOR" long:"forwarder-operator" description:"Base64URL encoded key deploying and flushing the forwarders"`
+	Ledger                string   `env:"LEDGER" long:"ledger" description:"Deposit crediting ledger the sweeps are linked in"`
+	DenyLists             []string `env:"DENY_LIST" env-delim:"," long:"deny-list" description:"CSV files of address,source,labels never sent funds and flagged as depositors"`
+	Quarantine            string   `env:"QUARANTINE" long:"quarantine" description:"File of the accounts excluded from automatic sweeps"`
+	PriceFeeds            string   `env:"PRICE_FEEDS" long:"price-feeds" description:"JSON file of network id to asset to Chainlink feed or Uniswap V3 pool, adds a value column"`
+	RPCConfig             string   `env:"RPC_CONFIG" long:"rpc-config" description:"JSON file of the headers, credentials, client certificates and proxies of the rpc urls"`
+	Claims                string   `env:"CLAIMS" long:"claims" description:"JSON file of the Merkle distributors, vesting wallets and staking contracts claimed before sweeping"`
+	KillSwitch            string   `env:"KILL_SWITCH" long:"kill-switch" description:"Sentinel file halting every signature while it exists, engaged with SIGUSR1 and released with SIGUSR2"`
+	Breaker               string   `env:"BREAKER" long:"breaker" description:"JSON file of the expectations the sweeps are checked against before anything is broadcast"`
+	Events                string   `env:"EVENTS" long:"events" description:"JSON file of the NATS server, subject prefix and outbox the scan, deposit and sweep events are published to"`
+	Database              string   `env:"DATABASE" long:"database" description:"SQLite database the balances, transactions and deposits are stored in"`
+	NoSweep               bool     `env:"NO_SWEEP" long:"no-sweep" description:"Never move funds, ignoring --swipe-address and --forwarder-operator wherever they come from"`
+	SwipeAddress          string   `env:"SWIPE_ADDRESS" long:"swipe-address" description:"Swipe address"`
+	Output                string   `env:"OUTPUT" long:"output" description:"Write results to file instead of stdout"`
+	Workers               int      `env:"WORKERS" long:"workers" default:"4" description:"Number of keys scanned concurrently"`
+	Progress              uint64   `env:"PROGRESS" long:"progress" default:"1000" description:"Log progress every N keys"`
+	AuditLog              string   `env:"AUDIT_LOG" long:"audit-log" description:"Append every plan, signature and broadcast to this hash-chained log"`
+	AuditKey              string   `env:"AUDIT_KEY" long:"audit-key" description:"Base64URL encoded private key signing the audit log entries"`
+	EncryptRecipients     []string `env:"ENCRYPT_RECIPIENT" env-delim:"," long:"encrypt-recipient" description:"Encrypt written files to this age recipient or recipients file"`
+	Identities            []string `env:"IDENTITY" env-delim:"," long:"identity" description:"age identity files to read encrypted files with"`
+	EncryptPassphrase     string   `env:"ENCRYPT_PASSPHRASE" long:"encrypt-passphrase" description:"Encrypt and read files with this passphrase instead"`
+	RequireEncryption     bool     `env:"REQUIRE_ENCRYPTION" long:"require-encryption" description:"Refuse to write unencrypted files"`
+	Secrets               string   `env:"SECRETS_FILE" long:"secrets" description:"age or sops encrypted YAML bundle of options, decrypted with --identity or a passphrase"`
 }
 
+// exitError is the error of a command exiting with a status of its own.
+type exitError struct {
+	status int
+	err    error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// check panics on err, without the secrets of the rpc urls it may contain.
 func check(err error) {
 	if err != nil {
-		panic(err)
+		panic(redactRPCError(err))
 	}
 }
 
-func printAccount(from common.Address, unit string, dec uint, balance *big.Int) {
-	fbal := &big.Float{}
-	fbal, ok := fbal.SetString(balance.String())
-	if !ok {
-		panic("Invalid balance value, got " + balance.String())
+func printAccount(w io.Writer, from common.Address, unit string, dec uint, balance *big.Int, price *big.Rat) {
+	value := formatUnits(balance, dec)
+	if price == nil {
+		fmt.Fprintf(w, "%s, balance: %v %s\n", from.Hex(), value, unit)
+		return
 	}
-	value := new(big.Float).Quo(fbal, big.NewFloat(math.Pow10(int(dec))))
-
-	fmt.Printf("%s, balance: %v %s\n", from.Hex(), value.String(), unit)
+	fmt.Fprintf(w, "%s, balance: %v %s, value: %s\n", from.Hex(), value, unit, new(big.Rat).Mul(amountRat(balance, dec), price).FloatString(2))
 }
 
 func getERC20Info(c *ethclient.Client, erc20 *ERC20Caller) (name string, symbol string, decimals uint) {
-	var err error
+	name, symbol, decimals, err := readERC20Info(erc20)
+	check(err)
+	return
+}
 
+// readERC20Info is getERC20Info returning the error of a token whose
+// decimals can not be read.
+func readERC20Info(erc20 *ERC20Caller) (name string, symbol string, decimals uint, err error) {
 	if erc20 == nil {
-		return "Ether", "ETH", 18
+		return "Ether", "ETH", 18, nil
 	}
 
 	_decimals, err := erc20.Decimals(&bind.CallOpts{})
-	check(err)
+	if err != nil {
+		return "", "", 0, err
+	}
 
 	name, err = erc20.Name(&bind.CallOpts{})
 	if err != nil {
@@ -66,129 +122,281 @@ func getERC20Info(c *ethclient.Client, erc20 *ERC20Caller) (name string, symbol
 		symbol = "ERC20"
 	}
 
-	decimals = uint(_decimals)
-	return
+	return name, symbol, uint(_decimals), nil
 }
 
 func SwipeToERC20(ctx context.Context, c *ethclient.Client, erc20Addr common.Address, fromKey *ecdsa.PrivateKey, to common.Address, value, networkId *big.Int) common.Hash {
+	check(screen.checkDestination(to))
 	erc20, err := NewERC20Transactor(erc20Addr, c)
 	check(err)
-	signedTx, err := erc20.Transfer(bind.NewKeyedTransactor(fromKey), to, value)
-	check(err)
 	from := crypto.PubkeyToAddress(fromKey.PublicKey)
+	if err := halted(); err != nil {
+		log.Printf("Not swiping ERC20 from %s: %v", from.String(), err)
+		return common.Hash{}
+	}
+	auth := bind.NewKeyedTransactor(fromKey)
+	sign := auth.Signer
+	auth.Signer = func(signer types.Signer, addr common.Address, tx *types.Transaction) (*types.Transaction, error) {
+		signedTx, err := sign(signer, addr, tx)
+		if err == nil {
+			fee := new(big.Int).Mul(tx.GasPrice(), new(big.Int).SetUint64(tx.Gas()))
+			audit("sign", map[string]string{"network_id": networkId.String(), "from": from.Hex(), "to": to.Hex(), "token": erc20Addr.Hex(), "value": value.String(), "fee": fee.String(), "nonce": fmt.Sprint(tx.Nonce()), "tx": signedTx.Hash().Hex()})
+		}
+		return signedTx, err
+	}
+	signedTx, err := erc20.Transfer(auth, to, value)
+	if err != nil {
+		audit("broadcast", map[string]string{"network_id": networkId.String(), "from": from.Hex(), "to": to.Hex(), "token": erc20Addr.Hex(), "value": value.String(), "error": redactRPCError(err).Error()})
+	}
+	check(err)
+	audit("broadcast", map[string]string{"network_id": networkId.String(), "from": from.Hex(), "to": to.Hex(), "token": erc20Addr.Hex(), "value": value.String(), "tx": signedTx.Hash().Hex()})
 	log.Printf("Swipping ERC20 from %s to %s amount: %s [%s]", from.String(), to.String(), value, signedTx.Hash().String())
 	return signedTx.Hash()
 }
 
-func SwipeTo(ctx context.Context, c *ethclient.Client, fromKey *ecdsa.PrivateKey, to common.Address, value, networkId *big.Int) {
-	from := crypto.PubkeyToAddress(fromKey.PublicKey)
-	nonce, err := c.NonceAt(ctx, from, nil)
-	check(err)
-	gasLimit := big.NewInt(21000)
+func suggestGasPrice(ctx context.Context, c *ethclient.Client) *big.Int {
 	gasPrice, err := c.SuggestGasPrice(ctx)
 	check(err)
 	if gasPrice.Cmp(&big.Int{}) == 0 {
 		gasPrice = new(big.Int).Mul(big.NewInt(110000), big.NewInt(10000))
 	}
+	return gasPrice
+}
+
+// SwipeTo sends value minus the fee to `to`. Nothing is sent when value
+// does not cover the fee, so that the value sent plus the fee never
+// exceeds value.
+func SwipeTo(ctx context.Context, c *ethclient.Client, fromKey *ecdsa.PrivateKey, to common.Address, value, networkId *big.Int) common.Hash {
+	gasLimit := big.NewInt(21000)
+	gasPrice := suggestGasPrice(ctx, c)
+	newValue, fee, ok := swipeValue(value, gasPrice, gasLimit)
+	if !ok {
+		log.Printf("Not swiping %s: amount %s does not cover the fee %s", crypto.PubkeyToAddress(fromKey.PublicKey).String(), value, fee)
+		return common.Hash{}
+	}
+	return sendEther(ctx, c, fromKey, to, newValue, gasPrice, gasLimit, networkId)
+}
+
+// swipeValue returns the value sent by a sweep of balance and its fee,
+// ok false when the balance does not cover the fee.
+func swipeValue(balance, gasPrice, gasLimit *big.Int) (value, fee *big.Int, ok bool) {
+	fee = new(big.Int).Mul(gasPrice, gasLimit)
+	if balance.Cmp(fee) <= 0 {
+		return nil, fee, false
+	}
+	return new(big.Int).Sub(balance, fee), fee, true
+}
+
+// TransferTo sends exactly value to `to`, the fee being paid on top of it.
+func TransferTo(ctx context.Context, c *ethclient.Client, fromKey *ecdsa.PrivateKey, to common.Address, value, networkId *big.Int) common.Hash {
+	return sendEther(ctx, c, fromKey, to, value, suggestGasPrice(ctx, c), big.NewInt(21000), networkId)
+}
+
+func sendEther(ctx context.Context, c *ethclient.Client, fromKey *ecdsa.PrivateKey, to common.Address, newValue, gasPrice, gasLimit, networkId *big.Int) common.Hash {
+	check(screen.checkDestination(to))
+	from := crypto.PubkeyToAddress(fromKey.PublicKey)
+	if err := halted(); err != nil {
+		log.Printf("Not sending from %s: %v", from.String(), err)
+		return common.Hash{}
+	}
+	nonce, err := c.NonceAt(ctx, from, nil)
+	check(err)
 	var data []byte
-	newValue := new(big.Int).Sub(value, new(big.Int).Mul(gasPrice, gasLimit))
 	tx := types.NewTransaction(nonce, to, newValue, gasLimit.Uint64(), gasPrice, data)
 	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(networkId), fromKey)
 	check(err)
+	audit("sign", map[string]string{"network_id": networkId.String(), "from": from.Hex(), "to": to.Hex(), "value": newValue.String(), "fee": new(big.Int).Mul(gasPrice, gasLimit).String(), "nonce": fmt.Sprint(nonce), "tx": signedTx.Hash().Hex()})
 	err = c.SendTransaction(ctx, signedTx)
+	if err != nil {
+		audit("broadcast", map[string]string{"network_id": networkId.String(), "tx": signedTx.Hash().Hex(), "error": redactRPCError(err).Error()})
+	}
 	check(err)
+	audit("broadcast", map[string]string{"network_id": networkId.String(), "tx": signedTx.Hash().Hex()})
 	log.Printf("Swipping amount: %s (%s fee) [%s]", newValue, gasPrice, signedTx.Hash().String())
+	return signedTx.Hash()
 }
 
+// ctx is cancelled on SIGINT and SIGTERM.
+var ctx context.Context
+
 func main() {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
-	ctx, cancelFunc := context.WithCancel(context.Background())
+	var cancelFunc context.CancelFunc
+	ctx, cancelFunc = context.WithCancel(context.Background())
 	go func() {
 		<-sigs
 		cancelFunc()
 		log.Fatal("Exit")
 	}()
-	_, err := flags.Parse(&opts)
+	check(loadSecrets(os.Args[1:]))
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.SubcommandsOptional = true
+	_, err := parser.AddCommand("call", "Call a contract method for every account",
+		"Call a view method of a contract on every rpc url with arguments where {account} is the address of each account and print the decoded results.", &callCommand{})
 	check(err)
-
-	var contractAddresses []common.Address
-	for _, contractAddr := range opts.ContractAddresses {
-		contractAddresses = append(contractAddresses, common.HexToAddress(contractAddr))
+	_, err = parser.AddCommand("check", "Check balances against rules",
+		"Scan the accounts and evaluate the rules of a rules file, exiting with status 3 if any rule fails.", &checkCommand{})
+	check(err)
+	_, err = parser.AddCommand("daemon", "Run scheduled jobs",
+		"Run the jobs of a daemon configuration file on their cron schedule until interrupted.", &daemonCommand{})
+	check(err)
+	_, err = parser.AddCommand("deposits", "Credit confirmed deposits",
+		"Write the confirmed ether and token deposits to the deposit addresses of the customers file to the --ledger.", &depositsCommand{})
+	check(err)
+	_, err = parser.AddCommand("plan", "Plan sweeps within a gas budget",
+		"Select the sweeps moving the most value for a gas budget per network and explain every choice.", &planCommand{})
+	check(err)
+	_, err = parser.AddCommand("query", "Query the results database",
+		"Run a preset such as history ADDRESS or movers, or an SQL query, against the --database and print the rows.", &queryCommand{})
+	check(err)
+	_, err = parser.AddCommand("rebalance", "Keep hot wallets between a floor and a ceiling",
+		"Move the excess of hot wallets above their ceiling to cold storage and request refills for those below their floor.", &rebalanceCommand{})
+	check(err)
+	_, err = parser.AddCommand("sandbox", "Run a local sandbox chain",
+		"Run an in-process dev chain with sample tokens and funded keys and print a command line to try the tool against it.", &sandboxCommand{})
+	check(err)
+	_, err = parser.AddCommand("verify-audit-log", "Verify an audit log",
+		"Verify the hash chain, the signatures and the head of an audit log.", &verifyAuditLogCommand{})
+	check(err)
+	parser.CommandHandler = func(command flags.Commander, args []string) error {
+		if err := applySecrets(parser); err != nil {
+			return err
+		}
+		if _, ok := command.(*daemonCommand); ok {
+			// The jobs publish the events, through outboxes of their own.
+			opts.Events = ""
+		}
+		if err := setup(); err != nil {
+			return err
+		}
+		if events != nil {
+			defer events.Close()
+		}
+		if results != nil {
+			defer results.Close()
+		}
+		if command != nil {
+			return command.Execute(args)
+		}
+		return scan()
 	}
+	_, err = parser.Parse()
+	// Exit once the command handler has closed everything.
+	var exit *exitError
+	if errors.As(err, &exit) {
+		os.Exit(exit.status)
+	}
+	check(err)
+}
 
-	var privateKeys []*ecdsa.PrivateKey
-	for _, privateKey := range opts.PrivateKeys {
-		str := privateKey
-		if strings.ContainsAny(str, "+/") {
-			log.Println("Bad private key, got:", privateKey)
-			panic("invalid base64url encoding")
+// setup initializes the process wide state from the global options.
+func setup() error {
+	var err error
+	if opts.Workers < 1 {
+		return fmt.Errorf("--workers must be at least 1, got %d", opts.Workers)
+	}
+	if opts.NoSweep {
+		opts.SwipeAddress = ""
+		opts.ForwarderOperator = ""
+	}
+	if opts.AuditLog != "" {
+		var key *ecdsa.PrivateKey
+		if opts.AuditKey != "" {
+			if key, err = decodeKey(opts.AuditKey); err != nil {
+				return fmt.Errorf("bad audit key: %v", err)
+			}
+		}
+		if auditor, err = openAuditLog(opts.AuditLog, key); err != nil {
+			return err
+		}
+	}
+	if len(opts.DenyLists) > 0 || opts.Quarantine != "" {
+		if screen, err = loadScreening(opts.DenyLists, opts.Quarantine); err != nil {
+			return err
 		}
-		str = strings.Replace(str, "-", "+", -1)
-		str = strings.Replace(str, "_", "/", -1)
-		str = strings.TrimSpace(str)
-		for len(str)%4 != 0 {
-			str += "="
+	}
+	if opts.PriceFeeds != "" {
+		if pricer, err = loadOracle(opts.PriceFeeds); err != nil {
+			return err
 		}
-		pkey, err := base64.StdEncoding.DecodeString(str)
-		if err != nil {
-			log.Println("Bad private key, got:", privateKey, "->")
-			check(err)
+	}
+	if opts.Ledger != "" {
+		if ledger, err = openLedger(opts.Ledger); err != nil {
+			return err
 		}
-		key, err := crypto.ToECDSA(pkey)
-		check(err)
-		privateKeys = append(privateKeys, key)
 	}
+	if opts.Database != "" {
+		if opts.RequireEncryption {
+			return fmt.Errorf("refusing --database, the results database is plaintext and --require-encryption is set")
+		}
+		if results, err = openResults(opts.Database); err != nil {
+			return err
+		}
+	}
+	if opts.Events != "" {
+		if events, err = loadPublisher(opts.Events); err != nil {
+			return err
+		}
+	}
+	if opts.Claims != "" {
+		if claimers, err = loadClaimers(opts.Claims); err != nil {
+			return err
+		}
+	}
+	if opts.Breaker != "" {
+		if circuit, err = loadBreaker(opts.Breaker); err != nil {
+			return err
+		}
+	}
+	if opts.KillSwitch != "" {
+		watchKillSwitchSignals()
+	}
+	if opts.RPCConfig != "" {
+		if rpcEndpoints, err = loadRPCConfig(opts.RPCConfig); err != nil {
+			return err
+		}
+	}
+	return dialBundlers(ctx)
+}
+
+// scan runs the default command: print the balances of every account and
+// swipe them if --swipe-address is set.
+func scan() error {
+	w, err := newResultWriter(opts.Output)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
 
-	var swipeTo common.Address
+	s, err := newScanner(ctx, w)
+	if err != nil {
+		return err
+	}
+	if opts.ForwarderOperator != "" && opts.SwipeAddress == "" {
+		log.Printf("Not flushing forwarders without --swipe-address")
+	} else if opts.ForwarderOperator != "" {
+		if s.operator, err = decodeKey(opts.ForwarderOperator); err != nil {
+			return fmt.Errorf("bad forwarder operator key: %v", err)
+		}
+		log.Printf("Flushing forwarders with %s", crypto.PubkeyToAddress(s.operator.PublicKey).Hex())
+	}
 	if opts.SwipeAddress != "" {
-		swipeTo = common.HexToAddress(opts.SwipeAddress)
-		log.Printf("Swipping all account to %s\n", swipeTo.String())
-	}
-	for _, rpcUrl := range opts.RPCURLs {
-		c, err := ethclient.Dial(rpcUrl)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		networkId, err := c.NetworkID(ctx)
-		check(err)
-
-		log.Printf("Connected to %v [network id: %s]", rpcUrl, networkId)
-
-		for _, key := range privateKeys {
-			from := crypto.PubkeyToAddress(key.PublicKey)
-			for _, contractAddr := range contractAddresses {
-				erc20, err := NewERC20Caller(contractAddr, c)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
-				bal, err := erc20.BalanceOf(&bind.CallOpts{}, from)
-				if err != nil {
-					continue
-				}
-				if bal.Cmp(&big.Int{}) == 0 {
-					continue
-				}
-				name, unit, dec := getERC20Info(c, erc20)
-				fmt.Printf("%v [%v]: \n", name, contractAddr.String())
-				printAccount(from, unit, dec, bal)
-				// Do not swipe tokens…
-				//if swipeTo != *new(common.Address) {
-				//	SwipeToERC20(ctx, c, contractAddr, key, swipeTo, bal, networkId)
-				//}
-			}
-			bal, err := c.BalanceAt(ctx, from, nil)
-			check(err)
-			_, unit, dec := getERC20Info(c, nil)
-			if bal.Cmp(&big.Int{}) != 0 {
-				printAccount(from, unit, dec, bal)
-				if swipeTo != *new(common.Address) {
-					SwipeTo(ctx, c, key, swipeTo, bal, networkId)
-				}
-			}
+		s.swipeTo = common.HexToAddress(opts.SwipeAddress)
+		if err := screen.checkDestination(s.swipeTo); err != nil {
+			return err
+		}
+		log.Printf("Swipping all account to %s\n", s.swipeTo.String())
+	}
+	if s.operator != nil && len(opts.ForwarderSalts) > 0 {
+		// The forwarders are flushed to the parent of the factory, which
+		// must be the screened swipe address.
+		if err := checkForwarderFactory(ctx, s.chains, &s.swipeTo); err != nil {
+			return err
 		}
 	}
+	err = s.run(ctx)
+	screen.report(w)
+	return err
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+func FuzzSwipeValue(f *testing.F) {
+	f.Add([]byte{0}, []byte{0}, uint64(21000))
+	f.Add([]byte{1}, []byte{1}, uint64(21000))
+	f.Add(big.NewInt(21000).Bytes(), []byte{1}, uint64(21000))
+	f.Add(big.NewInt(1e18).Bytes(), big.NewInt(30e9).Bytes(), uint64(21000))
+	f.Fuzz(func(t *testing.T, balance, gasPrice []byte, gasLimit uint64) {
+		bal := new(big.Int).SetBytes(balance)
+		value, fee, ok := swipeValue(bal, new(big.Int).SetBytes(gasPrice), new(big.Int).SetUint64(gasLimit))
+		if fee.Sign() < 0 {
+			t.Fatalf("negative fee %s", fee)
+		}
+		if !ok {
+			if bal.Cmp(fee) > 0 {
+				t.Fatalf("balance %s covers the fee %s but is not swept", bal, fee)
+			}
+			return
+		}
+		if value.Sign() <= 0 {
+			t.Fatalf("balance %s, fee %s: value %s is not positive", bal, fee, value)
+		}
+		if new(big.Int).Add(value, fee).Cmp(bal) > 0 {
+			t.Fatalf("value %s plus fee %s exceeds the balance %s", value, fee, bal)
+		}
+	})
+}
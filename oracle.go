@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// AggregatorV3ABI is the ABI of AggregatorV3Interface of oracle.sol.
+const AggregatorV3ABI = `[{"inputs":[],"name":"decimals","outputs":[{"name":"","type":"uint8"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"description","outputs":[{"name":"","type":"string"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"latestRoundData","outputs":[{"name":"roundId","type":"uint80"},{"name":"answer","type":"int256"},{"name":"startedAt","type":"uint256"},{"name":"updatedAt","type":"uint256"},{"name":"answeredInRound","type":"uint80"}],"stateMutability":"view","type":"function"}]`
+
+// UniswapV3PoolABI is the ABI of UniswapV3Pool of oracle.sol.
+const UniswapV3PoolABI = `[{"inputs":[],"name":"token0","outputs":[{"name":"","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"token1","outputs":[{"name":"","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[{"name":"secondsAgos","type":"uint32[]"}],"name":"observe","outputs":[{"name":"tickCumulatives","type":"int56[]"},{"name":"secondsPerLiquidityCumulativeX128s","type":"uint160[]"}],"stateMutability":"view","type":"function"}]`
+
+// priceSource prices assets, of ether when token is nil.
+type priceSource interface {
+	price(ch *chain, token *common.Address, symbol string) (*big.Rat, error)
+}
+
+func (p prices) price(ch *chain, token *common.Address, symbol string) (*big.Rat, error) {
+	if r, ok := p.of(ch.networkId, token, symbol); ok {
+		return r, nil
+	}
+	return nil, fmt.Errorf("no price for %s", symbol)
+}
+
+// priceFeed prices an asset with a Chainlink aggregator or, without one,
+// with the TWAP of a Uniswap V3 pool against a quote asset.
+type priceFeed struct {
+	Feed common.Address `json:"feed"`
+	// MaxAge is the oldest answer accepted, 1h by default.
+	MaxAge string `json:"max_age"`
+	// Min and Max bound the accepted answers.
+	Min string `json:"min"`
+	Max string `json:"max"`
+
+	Pool common.Address `json:"pool"`
+	// Window of the TWAP, 30m by default.
+	Window string `json:"window"`
+	// Quote is the other asset of the pool, ETH or a token address, priced
+	// in turn.
+	Quote string `json:"quote"`
+}
+
+// oracle prices assets on chain from a per network map of asset to feed.
+type oracle struct {
+	feeds map[string]map[string]priceFeed
+
+	mu    sync.Mutex
+	cache map[string]*big.Rat
+}
+
+// pricer prices the scanned balances, nil when no --price-feeds is given.
+var pricer priceSource
+
+// loadOracle reads a JSON file of network id to asset (ETH or a token
+// address) to priceFeed.
+func loadOracle(path string) (*oracle, error) {
+	data, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	o := &oracle{feeds: make(map[string]map[string]priceFeed), cache: make(map[string]*big.Rat)}
+	var raw map[string]map[string]priceFeed
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for network, feeds := range raw {
+		o.feeds[network] = make(map[string]priceFeed)
+		for asset, feed := range feeds {
+			if feed.Window != "" {
+				// The TWAP divides by the window in seconds.
+				if window, err := time.ParseDuration(feed.Window); err != nil || window < time.Second {
+					return nil, fmt.Errorf("%s: %s/%s: invalid window %q, at least 1s", path, network, asset, feed.Window)
+				}
+			}
+			o.feeds[network][strings.ToLower(asset)] = feed
+		}
+	}
+	return o, nil
+}
+
+func (o *oracle) price(ch *chain, token *common.Address, symbol string) (*big.Rat, error) {
+	asset := "eth"
+	if token != nil {
+		asset = strings.ToLower(token.Hex())
+	}
+	return o.priceAsset(ch, asset, 0)
+}
+
+// priceAsset prices asset, following quotes up to a depth of 3.
+func (o *oracle) priceAsset(ch *chain, asset string, depth int) (*big.Rat, error) {
+	key := ch.networkId.String() + "/" + asset
+	o.mu.Lock()
+	r, ok := o.cache[key]
+	o.mu.Unlock()
+	if ok {
+		return r, nil
+	}
+	feed, ok := o.feeds[ch.networkId.String()][asset]
+	if !ok {
+		return nil, fmt.Errorf("no price feed for %s", asset)
+	}
+	var err error
+	switch {
+	case feed.Feed != (common.Address{}):
+		r, err = o.chainlink(ch, feed)
+	case feed.Pool != (common.Address{}):
+		if depth >= 3 {
+			return nil, fmt.Errorf("too many quotes pricing %s", asset)
+		}
+		r, err = o.twap(ch, asset, feed, depth)
+	default:
+		err = fmt.Errorf("price feed of %s has neither feed nor pool", asset)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", asset, err)
+	}
+	o.mu.Lock()
+	o.cache[key] = r
+	o.mu.Unlock()
+	return r, nil
+}
+
+// chainlink returns the latest answer of feed after checking it is
+// complete, fresh and within bounds.
+func (o *oracle) chainlink(ch *chain, feed priceFeed) (*big.Rat, error) {
+	parsed, err := abi.JSON(strings.NewReader(AggregatorV3ABI))
+	if err != nil {
+		return nil, err
+	}
+	aggregator := bind.NewBoundContract(feed.Feed, parsed, ch.client, ch.client, ch.client)
+	callOpts := &bind.CallOpts{Context: ctx}
+	var decimals uint8
+	if err := aggregator.Call(callOpts, &decimals, "decimals"); err != nil {
+		return nil, err
+	}
+	var round struct {
+		RoundId         *big.Int
+		Answer          *big.Int
+		StartedAt       *big.Int
+		UpdatedAt       *big.Int
+		AnsweredInRound *big.Int
+	}
+	if err := aggregator.Call(callOpts, &round, "latestRoundData"); err != nil {
+		return nil, err
+	}
+	if round.Answer.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid answer %s", round.Answer)
+	}
+	if round.UpdatedAt.Sign() == 0 {
+		return nil, fmt.Errorf("incomplete round %s", round.RoundId)
+	}
+	if round.AnsweredInRound.Cmp(round.RoundId) < 0 {
+		return nil, fmt.Errorf("stale round %s answered in %s", round.RoundId, round.AnsweredInRound)
+	}
+	maxAge := time.Hour
+	if feed.MaxAge != "" {
+		if maxAge, err = time.ParseDuration(feed.MaxAge); err != nil {
+			return nil, err
+		}
+	}
+	if age := time.Since(time.Unix(round.UpdatedAt.Int64(), 0)); age > maxAge {
+		return nil, fmt.Errorf("answer is %s old, more than %s", age.Round(time.Second), maxAge)
+	}
+	r := amountRat(round.Answer, uint(decimals))
+	if feed.Min != "" {
+		if min, ok := new(big.Rat).SetString(feed.Min); !ok || r.Cmp(min) < 0 {
+			return nil, fmt.Errorf("answer %s below %s", ratString(r), feed.Min)
+		}
+	}
+	if feed.Max != "" {
+		if max, ok := new(big.Rat).SetString(feed.Max); !ok || r.Cmp(max) > 0 {
+			return nil, fmt.Errorf("answer %s above %s", ratString(r), feed.Max)
+		}
+	}
+	return r, nil
+}
+
+// twap returns the price of asset from the time weighted average tick of
+// the pool of feed over its window, times the price of its quote.
+func (o *oracle) twap(ch *chain, asset string, feed priceFeed, depth int) (*big.Rat, error) {
+	window := 30 * time.Minute
+	if feed.Window != "" {
+		var err error
+		if window, err = time.ParseDuration(feed.Window); err != nil {
+			return nil, err
+		}
+	}
+	parsed, err := abi.JSON(strings.NewReader(UniswapV3PoolABI))
+	if err != nil {
+		return nil, err
+	}
+	pool := bind.NewBoundContract(feed.Pool, parsed, ch.client, ch.client, ch.client)
+	callOpts := &bind.CallOpts{Context: ctx}
+	var token0, token1 common.Address
+	if err := pool.Call(callOpts, &token0, "token0"); err != nil {
+		return nil, err
+	}
+	if err := pool.Call(callOpts, &token1, "token1"); err != nil {
+		return nil, err
+	}
+	var obs struct {
+		TickCumulatives                    []*big.Int
+		SecondsPerLiquidityCumulativeX128s []*big.Int
+	}
+	seconds := uint32(window / time.Second)
+	if err := pool.Call(callOpts, &obs, "observe", []uint32{seconds, 0}); err != nil {
+		return nil, err
+	}
+	if len(obs.TickCumulatives) != 2 {
+		return nil, fmt.Errorf("invalid observation")
+	}
+	delta := new(big.Int).Sub(obs.TickCumulatives[1], obs.TickCumulatives[0])
+	tick := new(big.Int).Div(delta, big.NewInt(int64(seconds)))
+	if delta.Sign() < 0 && new(big.Int).Mod(delta, big.NewInt(int64(seconds))).Sign() != 0 {
+		tick.Sub(tick, big.NewInt(1))
+	}
+
+	var decimals [2]uint
+	for i, token := range []common.Address{token0, token1} {
+		erc20, err := NewERC20Caller(token, ch.client)
+		if err != nil {
+			return nil, err
+		}
+		info, err := ch.readTokenInfo(token, erc20)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %v", feed.Pool.Hex(), err)
+		}
+		decimals[i] = info.decimals
+	}
+	if !tick.IsInt64() || tick.Int64() < -maxTick || tick.Int64() > maxTick {
+		return nil, fmt.Errorf("invalid tick %s", tick)
+	}
+	// Units of token1 per unit of token0.
+	r, _ := tickPrice(tick.Int64()).Rat(nil)
+	r.Mul(r, new(big.Rat).SetFrac(pow10(decimals[0]), pow10(decimals[1])))
+	switch strings.ToLower(asset) {
+	case strings.ToLower(token0.Hex()):
+	case strings.ToLower(token1.Hex()):
+		r.Inv(r)
+	default:
+		return nil, fmt.Errorf("pool %s does not hold %s", feed.Pool.Hex(), asset)
+	}
+	quote := strings.ToLower(feed.Quote)
+	if quote == "" {
+		return nil, fmt.Errorf("pool price feed without quote")
+	}
+	quotePrice, err := o.priceAsset(ch, quote, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	return r.Mul(r, quotePrice), nil
+}
+
+// maxTick is the largest tick of a Uniswap V3 pool.
+const maxTick = 887272
+
+// tickPrecision is the precision in bits of the tick prices, enough for
+// the largest ticks to keep the precision of their token amounts.
+const tickPrecision = 512
+
+// tickPrice returns 1.0001^tick, the raw price of a Uniswap V3 tick.
+func tickPrice(tick int64) *big.Float {
+	base, _ := new(big.Float).SetPrec(tickPrecision).SetString("1.0001")
+	p := new(big.Float).SetPrec(tickPrecision).SetInt64(1)
+	n := tick
+	if n < 0 {
+		n = -n
+	}
+	for ; n > 0; n >>= 1 {
+		if n&1 == 1 {
+			p.Mul(p, base)
+		}
+		base.Mul(base, base)
+	}
+	if tick < 0 {
+		p.Quo(new(big.Float).SetPrec(tickPrecision).SetInt64(1), p)
+	}
+	return p
+}
+
+// pow10 returns 10^n.
+func pow10(n uint) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// mustERC20Caller binds the ERC20 at addr, which can not fail.
+func mustERC20Caller(addr common.Address, ch *chain) *ERC20Caller {
+	erc20, err := NewERC20Caller(addr, ch.client)
+	check(err)
+	return erc20
+}
@@ -0,0 +1,15 @@
+pragma solidity ^0.5.0;
+
+// AggregatorV3Interface is the Chainlink price feed interface.
+contract AggregatorV3Interface {
+    function decimals() external view returns (uint8);
+    function description() external view returns (string memory);
+    function latestRoundData() external view returns (uint80 roundId, int256 answer, uint256 startedAt, uint256 updatedAt, uint80 answeredInRound);
+}
+
+// UniswapV3Pool is the part of the Uniswap V3 pool interface used for TWAPs.
+contract UniswapV3Pool {
+    function token0() external view returns (address);
+    function token1() external view returns (address);
+    function observe(uint32[] calldata secondsAgos) external view returns (int56[] memory tickCumulatives, uint160[] memory secondsPerLiquidityCumulativeX128s);
+}
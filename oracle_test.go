@@ -0,0 +1,26 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+// TestTickPrice compares the price of the largest tick to its square root
+// price in the Uniswap V3 TickMath, itself exact to about 1e-19.
+func TestTickPrice(t *testing.T) {
+	sqrtPriceX96, _ := new(big.Int).SetString("1461446703485210103287273052203988822378723970342", 10)
+	want := new(big.Rat).SetFrac(new(big.Int).Mul(sqrtPriceX96, sqrtPriceX96), new(big.Int).Lsh(big.NewInt(1), 192))
+	for _, tick := range []int64{maxTick, -maxTick} {
+		got, _ := tickPrice(tick).Rat(nil)
+		if tick < 0 {
+			got.Inv(got)
+		}
+		diff := new(big.Rat).Quo(new(big.Rat).Sub(got, want), want)
+		if f, _ := diff.Float64(); f > 1e-18 || f < -1e-18 {
+			t.Errorf("tickPrice(%d) off by %g", tick, f)
+		}
+	}
+	if p, _ := tickPrice(0).Float64(); p != 1 {
+		t.Errorf("tickPrice(0) = %g, want 1", p)
+	}
+}
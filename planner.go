@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// prices maps assets to their price, see loadPrices.
+type prices map[string]*big.Rat
+
+// loadPrices reads a JSON file of asset to price. Assets are ETH, token
+// addresses or symbols, optionally prefixed with a network id and a slash
+// to price them on one network only.
+func loadPrices(path string) (prices, error) {
+	data, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	p := make(prices)
+	for asset, price := range raw {
+		r, ok := new(big.Rat).SetString(price)
+		if !ok {
+			return nil, fmt.Errorf("%s: invalid price %q of %s", path, price, asset)
+		}
+		p[strings.ToLower(asset)] = r
+	}
+	return p, nil
+}
+
+// of returns the price of one unit of the asset of b.
+func (p prices) of(networkId *big.Int, token *common.Address, symbol string) (*big.Rat, bool) {
+	var keys []string
+	if token == nil {
+		keys = []string{"eth"}
+	} else {
+		keys = []string{strings.ToLower(token.Hex()), strings.ToLower(symbol)}
+	}
+	for _, key := range keys {
+		if r, ok := p[networkId.String()+"/"+key]; ok {
+			return r, true
+		}
+	}
+	for _, key := range keys {
+		if r, ok := p[key]; ok {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// sweepItem is a candidate sweep of an asset of an account.
+type sweepItem struct {
+	balance
+	fee      *big.Int
+	value    float64
+	feeValue float64
+	included bool
+	reason   string
+}
+
+type planCommand struct {
+	Prices     string   `long:"prices" description:"JSON file of asset prices, defaults to the --price-feeds"`
+	GasBudgets []string `long:"gas-budget" description:"Ether spent on gas per run, prefixed with network id= to set it for one network"`
+	ERC20Gas   uint64   `long:"erc20-gas" default:"65000" description:"Gas of a token transfer"`
+	Resolution int      `long:"resolution" default:"1000" description:"Number of steps the gas budget is divided into"`
+	Send       bool     `long:"execute" description:"Send the included sweeps to --swipe-address"`
+}
+
+// budget returns the gas budget of networkId in wei, nil if unlimited.
+func (c *planCommand) budget(networkId *big.Int) (*big.Int, error) {
+	var budget *big.Int
+	for _, b := range c.GasBudgets {
+		network, amount := "", b
+		if i := strings.Index(b, "="); i >= 0 {
+			network, amount = b[:i], b[i+1:]
+		}
+		if network != "" && network != networkId.String() {
+			continue
+		}
+		wei, err := parseAmount(amount, 18)
+		if err != nil {
+			return nil, err
+		}
+		if budget == nil || network != "" {
+			budget = wei
+		}
+	}
+	return budget, nil
+}
+
+func (c *planCommand) Execute(args []string) error {
+	p := pricer
+	if c.Prices != "" {
+		var err error
+		if p, err = loadPrices(c.Prices); err != nil {
+			return err
+		}
+	}
+	if p == nil {
+		return fmt.Errorf("no prices, use --prices or --price-feeds")
+	}
+	var swipeTo common.Address
+	if c.Send {
+		if opts.SwipeAddress == "" {
+			return fmt.Errorf("--execute needs --swipe-address")
+		}
+		swipeTo = common.HexToAddress(opts.SwipeAddress)
+		if err := screen.checkDestination(swipeTo); err != nil {
+			return err
+		}
+	}
+
+	var balances []balance
+	s, err := newScanner(ctx, ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	s.onBalance = func(b balance) {
+		balances = append(balances, b)
+	}
+	if err := s.run(ctx); err != nil {
+		return err
+	}
+
+	var plans [][]*sweepItem
+	for _, ch := range s.chains {
+		budget, err := c.budget(ch.networkId)
+		if err != nil {
+			return err
+		}
+		gasPrice := suggestGasPrice(ctx, ch.client)
+		ethPrice, ethPriceErr := p.price(ch, nil, "ETH")
+
+		ethBalances := make(map[common.Address]*big.Int)
+		for _, b := range balances {
+			if b.networkId.Cmp(ch.networkId) == 0 && b.token == nil {
+				ethBalances[b.account] = b.amount
+			}
+		}
+		var items []*sweepItem
+		for _, b := range balances {
+			if b.networkId.Cmp(ch.networkId) != 0 {
+				continue
+			}
+			item := &sweepItem{balance: b}
+			items = append(items, item)
+			gas := c.ERC20Gas
+			if b.token == nil {
+				gas = 21000
+			}
+			item.fee = new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(gas))
+			price, priceErr := p.price(ch, b.token, b.info.symbol)
+			switch {
+			case b.key == nil:
+				item.reason = "skipped: watch-only account"
+				continue
+			case screen.isQuarantined(b.account):
+				item.reason = "skipped: quarantined account"
+				continue
+			case ethPriceErr != nil:
+				item.reason = "skipped: " + ethPriceErr.Error()
+				continue
+			case priceErr != nil:
+				item.reason = "skipped: " + priceErr.Error()
+				continue
+			case b.token != nil && (ethBalances[b.account] == nil || ethBalances[b.account].Cmp(item.fee) < 0):
+				item.reason = "skipped: not enough ether for gas"
+				continue
+			}
+			item.feeValue, _ = new(big.Rat).Mul(amountRat(item.fee, 18), ethPrice).Float64()
+			amount := b.amount
+			if b.token == nil {
+				amount = new(big.Int).Sub(b.amount, item.fee)
+			}
+			item.value, _ = new(big.Rat).Mul(amountRat(amount, b.info.decimals), price).Float64()
+			if item.feeValue >= item.value {
+				item.reason = "skipped: fee exceeds value"
+				continue
+			}
+			item.reason = "candidate"
+		}
+		fundGas(items, ethBalances)
+		selectSweeps(items, budget, c.Resolution)
+		c.print(ch, budget, items)
+		plans = append(plans, items)
+	}
+	if !c.Send {
+		return nil
+	}
+	var intents []sweepIntent
+	for i, items := range plans {
+		intents = append(intents, c.intents(p, s.chains[i], items)...)
+	}
+	for _, in := range intents {
+		publishPlanned(in)
+	}
+	if circuit != nil {
+		if err := circuit.evaluate(intents); err != nil {
+			return err
+		}
+	}
+	for i, items := range plans {
+		c.execute(s.chains[i], swipeTo, items)
+	}
+	return nil
+}
+
+// intents returns the sweep intents of the included items, priced with p.
+func (c *planCommand) intents(p priceSource, ch *chain, items []*sweepItem) []sweepIntent {
+	var intents []sweepIntent
+	for _, item := range items {
+		if !item.included {
+			continue
+		}
+		in := sweepIntent{networkId: ch.networkId, account: item.account, asset: "ETH", symbol: item.info.symbol, decimals: item.info.decimals, amount: item.amount, fee: item.fee}
+		if item.token == nil {
+			in.amount = new(big.Int).Sub(item.amount, item.fee)
+		} else {
+			in.asset = item.token.Hex()
+		}
+		if price, err := p.price(ch, item.token, item.info.symbol); err == nil {
+			in.value = new(big.Rat).Mul(amountRat(in.amount, in.decimals), price)
+		}
+		if price, err := p.price(ch, nil, "ETH"); err == nil {
+			in.feeValue = new(big.Rat).Mul(amountRat(item.fee, 18), price)
+		}
+		intents = append(intents, in)
+	}
+	return intents
+}
+
+// selectSweeps includes the candidate items maximizing the value moved
+// with a total fee within budget, solving the 0/1 knapsack problem with
+// fees rounded up to resolution steps of the budget.
+func selectSweeps(items []*sweepItem, budget *big.Int, resolution int) {
+	var candidates []*sweepItem
+	for _, item := range items {
+		if item.reason == "candidate" {
+			candidates = append(candidates, item)
+		}
+	}
+	if budget == nil {
+		for _, item := range candidates {
+			item.included, item.reason = true, "included: no gas budget"
+		}
+		return
+	}
+	if resolution < 1 {
+		resolution = 1
+	}
+
+	// Fees in budget steps, rounded up so the budget is never exceeded.
+	step := new(big.Int).Div(budget, big.NewInt(int64(resolution)))
+	if step.Sign() == 0 {
+		step.SetInt64(1)
+	}
+	capacity := int(new(big.Int).Div(budget, step).Int64())
+	weights := make([]int, len(candidates))
+	for i, item := range candidates {
+		q, r := new(big.Int).QuoRem(item.fee, step, new(big.Int))
+		if r.Sign() != 0 {
+			q.Add(q, big.NewInt(1))
+		}
+		if q.Cmp(big.NewInt(int64(capacity))) > 0 {
+			weights[i] = capacity + 1
+		} else {
+			weights[i] = int(q.Int64())
+		}
+	}
+
+	best := make([]float64, capacity+1)
+	words := (capacity + 64) / 64
+	taken := make([][]uint64, len(candidates))
+	for i, item := range candidates {
+		taken[i] = make([]uint64, words)
+		w := weights[i]
+		for room := capacity; room >= w; room-- {
+			if v := best[room-w] + item.value; v > best[room] {
+				best[room] = v
+				taken[i][room/64] |= 1 << uint(room%64)
+			}
+		}
+	}
+	room := capacity
+	for i := len(candidates) - 1; i >= 0; i-- {
+		item := candidates[i]
+		if taken[i][room/64]&(1<<uint(room%64)) != 0 {
+			item.included, item.reason = true, "included: within gas budget"
+			room -= weights[i]
+		} else if weights[i] > capacity {
+			item.reason = "deferred: fee alone exceeds the gas budget"
+		} else {
+			item.reason = "deferred: gas budget better spent on larger sweeps"
+		}
+	}
+}
+
+// fundGas skips the candidate token sweeps of an account beyond what its
+// ether can pay the gas of, keeping the most valuable ones, so that any
+// selection of the candidates can be executed.
+func fundGas(items []*sweepItem, ethBalances map[common.Address]*big.Int) {
+	byAccount := make(map[common.Address][]*sweepItem)
+	for _, item := range items {
+		if item.reason == "candidate" && item.token != nil {
+			byAccount[item.account] = append(byAccount[item.account], item)
+		}
+	}
+	for account, tokens := range byAccount {
+		sort.SliceStable(tokens, func(i, j int) bool {
+			return tokens[i].value > tokens[j].value
+		})
+		left := new(big.Int)
+		if ethBalances[account] != nil {
+			left.Set(ethBalances[account])
+		}
+		for _, item := range tokens {
+			if left.Cmp(item.fee) < 0 {
+				item.reason = "skipped: not enough ether for the gas of every token sweep"
+				continue
+			}
+			left.Sub(left, item.fee)
+		}
+	}
+}
+
+// print writes the plan of ch.
+func (c *planCommand) print(ch *chain, budget *big.Int, items []*sweepItem) {
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].included != items[j].included {
+			return items[i].included
+		}
+		return items[i].value > items[j].value
+	})
+	spent, moved := new(big.Int), 0.0
+	for _, item := range items {
+		if item.included {
+			spent.Add(spent, item.fee)
+			moved += item.value
+		}
+	}
+	limit := "unlimited"
+	if budget != nil {
+		limit = formatUnits(budget, 18) + " ETH"
+	}
+	fmt.Printf("Network %s: plan moves %s for %s ETH of gas (budget %s)\n", ch.networkId, formatValue(moved), formatUnits(spent, 18), limit)
+	for _, item := range items {
+		fmt.Printf("%s, %s %s, value %s, fee %s ETH (%s): %s\n",
+			item.account.Hex(), formatUnits(item.amount, item.info.decimals), item.info.symbol,
+			formatValue(item.value), formatUnits(item.fee, 18), formatValue(item.feeValue), item.reason)
+	}
+}
+
+// execute sends the included sweeps of ch, tokens first so that the ether
+// sweep of an account is made with what the token sweeps left.
+func (c *planCommand) execute(ch *chain, to common.Address, items []*sweepItem) {
+	for _, item := range items {
+		if !item.included || item.token == nil {
+			continue
+		}
+		if c.cancelled(ch) {
+			return
+		}
+		bal, err := ch.client.BalanceAt(ctx, item.account, nil)
+		check(err)
+		if bal.Cmp(item.fee) < 0 {
+			log.Printf("%s: ether balance %s no longer covers the fee of %s", item.account.Hex(), bal, item.info.symbol)
+			continue
+		}
+		audit("plan", map[string]string{"network_id": ch.networkId.String(), "from": item.account.Hex(), "to": to.Hex(), "asset": item.token.Hex(), "balance": item.amount.String(), "reason": item.reason})
+		tx := SwipeToERC20(ctx, ch.client, *item.token, item.key, to, item.amount, ch.networkId)
+		recordSweep(ch, item.account, item.token.Hex(), tx)
+	}
+	for _, item := range items {
+		if !item.included || item.token != nil {
+			continue
+		}
+		if c.cancelled(ch) {
+			return
+		}
+		bal, err := ch.client.BalanceAt(ctx, item.account, nil)
+		check(err)
+		if bal.Cmp(item.fee) <= 0 {
+			log.Printf("%s: balance %s no longer covers the fee", item.account.Hex(), bal)
+			continue
+		}
+		audit("plan", map[string]string{"network_id": ch.networkId.String(), "from": item.account.Hex(), "to": to.Hex(), "asset": "ETH", "balance": bal.String(), "reason": item.reason})
+		tx := SwipeTo(ctx, ch.client, item.key, to, bal, ch.networkId)
+		recordSweep(ch, item.account, "ETH", tx)
+	}
+}
+
+// cancelled tells whether the kill switch cancels the rest of the plan.
+func (c *planCommand) cancelled(ch *chain) bool {
+	err := halted()
+	if err == nil {
+		return false
+	}
+	audit("cancel", map[string]string{"network_id": ch.networkId.String(), "reason": err.Error()})
+	log.Printf("Network %s: plan cancelled: %v", ch.networkId, err)
+	return true
+}
+
+// formatValue formats a value in the unit of the prices.
+func formatValue(v float64) string {
+	if math.IsNaN(v) || v == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%.2f", v)
+}
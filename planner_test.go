@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math/big"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func candidate(fee int64, value float64) *sweepItem {
+	return &sweepItem{fee: big.NewInt(fee), value: value, reason: "candidate"}
+}
+
+func TestSelectSweeps(t *testing.T) {
+	small1, small2, large := candidate(50, 7), candidate(50, 7), candidate(60, 10)
+	expensive, planned := candidate(150, 100), &sweepItem{fee: big.NewInt(1), value: 1, reason: "skipped: below the minimum"}
+	items := []*sweepItem{large, small1, expensive, small2, planned}
+	selectSweeps(items, big.NewInt(100), 100)
+	for _, c := range []struct {
+		item     *sweepItem
+		included bool
+		reason   string
+	}{
+		{small1, true, "included: within gas budget"},
+		{small2, true, "included: within gas budget"},
+		{large, false, "deferred: gas budget better spent on larger sweeps"},
+		{expensive, false, "deferred: fee alone exceeds the gas budget"},
+		{planned, false, "skipped: below the minimum"},
+	} {
+		if c.item.included != c.included || c.item.reason != c.reason {
+			t.Errorf("fee %s: included %v, %q, want %v, %q", c.item.fee, c.item.included, c.item.reason, c.included, c.reason)
+		}
+	}
+
+	items = []*sweepItem{candidate(1000, 1), candidate(1, 1)}
+	selectSweeps(items, nil, 100)
+	for _, item := range items {
+		if !item.included {
+			t.Errorf("fee %s not included without budget", item.fee)
+		}
+	}
+}
+
+// TestSelectSweepsOptimal compares the selection to every subset of the
+// candidates.
+func TestSelectSweepsOptimal(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 200; round++ {
+		budget := int64(1 + rng.Intn(1000))
+		items := make([]*sweepItem, 1+rng.Intn(10))
+		for i := range items {
+			items[i] = candidate(int64(1+rng.Intn(600)), float64(rng.Intn(100)))
+		}
+		// Fees are exact with one step per wei.
+		selectSweeps(items, big.NewInt(budget), int(budget))
+		var fee int64
+		var value float64
+		for _, item := range items {
+			if item.included {
+				fee += item.fee.Int64()
+				value += item.value
+			}
+		}
+		if fee > budget {
+			t.Fatalf("round %d: fees %d exceed the budget %d", round, fee, budget)
+		}
+		best := 0.0
+		for set := 0; set < 1<<uint(len(items)); set++ {
+			var f int64
+			var v float64
+			for i, item := range items {
+				if set&(1<<uint(i)) != 0 {
+					f += item.fee.Int64()
+					v += item.value
+				}
+			}
+			if f <= budget && v > best {
+				best = v
+			}
+		}
+		if value != best {
+			t.Fatalf("round %d: selected a value of %v, best is %v", round, value, best)
+		}
+	}
+}
+
+// TestSelectSweepsRounding checks that fees rounded to budget steps never
+// exceed the budget.
+func TestSelectSweepsRounding(t *testing.T) {
+	items := []*sweepItem{candidate(41, 5), candidate(59, 5)}
+	selectSweeps(items, big.NewInt(100), 10)
+	n := 0
+	for _, item := range items {
+		if item.included {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("%d sweeps included, want 1 once fees are rounded up", n)
+	}
+}
+
+func TestFundGas(t *testing.T) {
+	funded, unfunded := common.HexToAddress("0x01"), common.HexToAddress("0x02")
+	token := common.HexToAddress("0x10")
+	tokenSweep := func(account common.Address, fee int64, value float64) *sweepItem {
+		item := candidate(fee, value)
+		item.account, item.token = account, &token
+		return item
+	}
+	low, high := tokenSweep(funded, 60, 5), tokenSweep(funded, 60, 9)
+	orphan := tokenSweep(unfunded, 1, 100)
+	ether := candidate(60, 1)
+	ether.account = funded
+	fundGas([]*sweepItem{low, high, orphan, ether}, map[common.Address]*big.Int{funded: big.NewInt(100)})
+
+	if high.reason != "candidate" || ether.reason != "candidate" {
+		t.Errorf("funded sweeps: %q, %q", high.reason, ether.reason)
+	}
+	for _, item := range []*sweepItem{low, orphan} {
+		if !strings.HasPrefix(item.reason, "skipped: not enough ether") {
+			t.Errorf("value %v: %q, want skipped", item.value, item.reason)
+		}
+	}
+}
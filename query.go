@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type queryCommand struct {
+	Since time.Duration `long:"since" default:"168h" description:"Period of the movers preset"`
+	Limit int           `long:"limit" default:"20" description:"Maximum number of rows of the presets"`
+}
+
+// queryPreset builds the query of a preset from its arguments.
+type queryPreset struct {
+	usage string
+	build func(c *queryCommand, args []string) (string, []interface{}, error)
+}
+
+var queryPresets = map[string]queryPreset{
+	"history": {"history ADDRESS: balance history of an account", func(c *queryCommand, args []string) (string, []interface{}, error) {
+		if len(args) != 1 || !common.IsHexAddress(args[0]) {
+			return "", nil, fmt.Errorf("usage: query history ADDRESS")
+		}
+		return `SELECT time, network_id, run_block, symbol, amount, value, balance FROM balances
+			WHERE account = ? ORDER BY id`, []interface{}{common.HexToAddress(args[0]).Hex()}, nil
+	}},
+	"latest": {"latest: last known non-zero balances, largest value first", func(c *queryCommand, args []string) (string, []interface{}, error) {
+		return `SELECT b.time, b.network_id, b.account, b.symbol, b.amount, b.value FROM balances b
+			JOIN (SELECT MAX(id) AS id FROM balances GROUP BY network_id, account, asset) l ON b.id = l.id
+			WHERE b.balance != '0' ORDER BY b.value IS NULL, b.value DESC, b.amount DESC LIMIT ?`, []interface{}{c.Limit}, nil
+	}},
+	"movers": {"movers: largest balance changes over --since, by value when priced", func(c *queryCommand, args []string) (string, []interface{}, error) {
+		since := time.Now().Add(-c.Since).UTC().Format(resultsTime)
+		return `WITH latest AS (SELECT network_id, account, asset, MAX(id) AS id FROM balances GROUP BY network_id, account, asset),
+			baseline AS (SELECT network_id, account, asset, MAX(id) AS id FROM balances WHERE time < ? GROUP BY network_id, account, asset)
+			SELECT n.network_id, n.account, n.symbol,
+				COALESCE(o.amount, 0) AS previous, n.amount, n.amount - COALESCE(o.amount, 0) AS change,
+				n.value - COALESCE(o.value, 0) AS value_change
+			FROM latest l JOIN balances n ON n.id = l.id
+			LEFT JOIN baseline b ON b.network_id = l.network_id AND b.account = l.account AND b.asset = l.asset
+			LEFT JOIN balances o ON o.id = b.id
+			WHERE n.time >= ? AND n.balance != COALESCE(o.balance, '0')
+			ORDER BY value_change IS NULL, ABS(value_change) DESC, ABS(change) DESC LIMIT ?`, []interface{}{since, since, c.Limit}, nil
+	}},
+	"transactions": {"transactions [ADDRESS]: last sweeps and claims, of an account if given", func(c *queryCommand, args []string) (string, []interface{}, error) {
+		if len(args) > 1 || len(args) == 1 && !common.IsHexAddress(args[0]) {
+			return "", nil, fmt.Errorf("usage: query transactions [ADDRESS]")
+		}
+		if len(args) == 1 {
+			return `SELECT time, network_id, kind, account, asset, tx_hash FROM transactions
+				WHERE account = ? ORDER BY id DESC LIMIT ?`, []interface{}{common.HexToAddress(args[0]).Hex(), c.Limit}, nil
+		}
+		return `SELECT time, network_id, kind, account, asset, tx_hash FROM transactions ORDER BY id DESC LIMIT ?`, []interface{}{c.Limit}, nil
+	}},
+	"deposits": {"deposits [CUSTOMER]: last credited deposits, of a customer if given", func(c *queryCommand, args []string) (string, []interface{}, error) {
+		if len(args) > 1 {
+			return "", nil, fmt.Errorf("usage: query deposits [CUSTOMER]")
+		}
+		if len(args) == 1 {
+			return `SELECT time, network_id, customer, account, sender, asset, amount, block, reversed, id FROM deposits
+				WHERE customer = ? ORDER BY time DESC LIMIT ?`, []interface{}{args[0], c.Limit}, nil
+		}
+		return `SELECT time, network_id, customer, account, sender, asset, amount, block, reversed, id FROM deposits
+			ORDER BY time DESC LIMIT ?`, []interface{}{c.Limit}, nil
+	}},
+}
+
+func (c *queryCommand) Execute(args []string) error {
+	if results == nil {
+		return fmt.Errorf("no results database, use --database")
+	}
+	if len(args) == 0 {
+		var usages []string
+		for _, p := range queryPresets {
+			usages = append(usages, "  "+p.usage)
+		}
+		sort.Strings(usages)
+		return fmt.Errorf("expected a preset or an SQL query, presets:\n%s", strings.Join(usages, "\n"))
+	}
+	query, params := strings.Join(args, " "), []interface{}(nil)
+	if p, ok := queryPresets[args[0]]; ok {
+		var err error
+		if query, params, err = p.build(c, args[1:]); err != nil {
+			return err
+		}
+	}
+	// Run the query on a connection of its own that can not write.
+	conn, err := results.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		conn.ExecContext(context.Background(), "PRAGMA query_only = OFF")
+		conn.Close()
+	}()
+	if _, err := conn.ExecContext(ctx, "PRAGMA query_only = ON"); err != nil {
+		return err
+	}
+	rows, err := conn.QueryContext(ctx, query, params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w, err := newResultWriter(opts.Output)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	return printRows(w, rows)
+}
+
+// printRows writes rows as a table with a header.
+func printRows(w io.Writer, rows *sql.Rows) error {
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(columns, "\t"))
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		fields := make([]string, len(values))
+		for i, v := range values {
+			switch v := v.(type) {
+			case nil:
+			case []byte:
+				fields[i] = string(v)
+			case float64:
+				fields[i] = strconv.FormatFloat(v, 'f', -1, 64)
+			default:
+				fields[i] = fmt.Sprint(v)
+			}
+		}
+		fmt.Fprintln(tw, strings.Join(fields, "\t"))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
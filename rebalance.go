@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// walletTarget is the range an asset of a hot wallet is kept in.
+type walletTarget struct {
+	// Asset is ETH or a token contract address.
+	Asset   string `json:"asset"`
+	Floor   string `json:"floor"`
+	Ceiling string `json:"ceiling"`
+	// Target is the balance restored when out of range, the middle of the
+	// range by default.
+	Target string `json:"target"`
+}
+
+// hotWallet is a wallet rebalanced against the cold storage.
+type hotWallet struct {
+	Name      string         `json:"name"`
+	Address   common.Address `json:"address"`
+	NetworkId string         `json:"network_id"`
+	Targets   []walletTarget `json:"targets"`
+}
+
+// rebalanceConfig is the content of a rebalance --config file.
+type rebalanceConfig struct {
+	Cold    common.Address `json:"cold"`
+	Wallets []hotWallet    `json:"wallets"`
+	// RefillOutput is the file the unsigned refill transactions are
+	// written to.
+	RefillOutput string `json:"refill_output"`
+	// NotifyURL receives the refill requests as a JSON POST.
+	NotifyURL string `json:"notify_url"`
+}
+
+// refillRequest asks the cold-side signers to top up a hot wallet. Tx is
+// the unsigned transaction doing it.
+type refillRequest struct {
+	Wallet    string         `json:"wallet"`
+	NetworkId string         `json:"network_id"`
+	Address   common.Address `json:"address"`
+	Asset     string         `json:"asset"`
+	Balance   string         `json:"balance"`
+	Floor     string         `json:"floor"`
+	Amount    string         `json:"amount"`
+	Tx        unsignedTx     `json:"tx"`
+}
+
+// unsignedTx is a transaction to be signed by the cold storage.
+type unsignedTx struct {
+	From     common.Address `json:"from"`
+	To       common.Address `json:"to"`
+	Nonce    hexutil.Uint64 `json:"nonce"`
+	Value    *hexutil.Big   `json:"value"`
+	Data     hexutil.Bytes  `json:"data"`
+	Gas      hexutil.Uint64 `json:"gas"`
+	GasPrice *hexutil.Big   `json:"gasPrice"`
+	ChainId  *hexutil.Big   `json:"chainId"`
+}
+
+type rebalanceCommand struct {
+	Config string `long:"config" required:"true" description:"JSON rebalance configuration file"`
+	DryRun bool   `long:"dry-run" description:"Print the moves and refills without sending anything"`
+}
+
+func (c *rebalanceCommand) Execute(args []string) error {
+	data, err := readFile(c.Config)
+	if err != nil {
+		return err
+	}
+	var cfg rebalanceConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("%s: %v", c.Config, err)
+	}
+	if cfg.Cold == (common.Address{}) {
+		return fmt.Errorf("%s: no cold address", c.Config)
+	}
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("%s: %v", c.Config, err)
+	}
+	if err := screen.checkDestination(cfg.Cold); err != nil {
+		return err
+	}
+
+	var balances []balance
+	s, err := newScanner(ctx, ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	s.onBalance = func(b balance) {
+		balances = append(balances, b)
+	}
+	if err := s.run(ctx); err != nil {
+		return err
+	}
+
+	var refills []refillRequest
+	// nonces is the next nonce of cold by network, the refills of a run
+	// taking consecutive nonces.
+	nonces := make(map[string]uint64)
+	for _, ch := range s.chains {
+		for _, w := range cfg.Wallets {
+			if w.NetworkId != "" && w.NetworkId != ch.networkId.String() {
+				continue
+			}
+			for _, t := range w.Targets {
+				refill, err := c.rebalance(s, ch, cfg.Cold, w, t, balances, nonces)
+				if err != nil {
+					return fmt.Errorf("%s %s: %v", w.Name, t.Asset, err)
+				}
+				if refill != nil {
+					refills = append(refills, *refill)
+				}
+			}
+		}
+	}
+	// The moves to cold storage are held by the circuit breaker like
+	// sweeps, the refill requests are written even if it trips.
+	flushErr := s.flush()
+	if len(refills) == 0 || c.DryRun {
+		return flushErr
+	}
+
+	data, err = json.MarshalIndent(refills, "", "  ")
+	if err != nil {
+		return err
+	}
+	if cfg.RefillOutput != "" {
+		if err := writeFile(cfg.RefillOutput, data); err != nil {
+			return err
+		}
+		log.Printf("%d refill requests written to %s", len(refills), cfg.RefillOutput)
+	}
+	if cfg.NotifyURL != "" {
+		resp, err := http.Post(cfg.NotifyURL, "application/json", bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("refill notification: %s", resp.Status)
+		}
+	}
+	return flushErr
+}
+
+// validate checks the assets and that every target is within its range.
+// Amounts are compared in units since the token decimals are not known
+// yet.
+func (cfg *rebalanceConfig) validate() error {
+	for _, w := range cfg.Wallets {
+		for _, t := range w.Targets {
+			if !strings.EqualFold(t.Asset, "ETH") && !common.IsHexAddress(t.Asset) {
+				return fmt.Errorf("%s %s: asset must be ETH or a token address", w.Name, t.Asset)
+			}
+			amounts := make(map[string]*big.Rat)
+			for name, s := range map[string]string{"floor": t.Floor, "ceiling": t.Ceiling, "target": t.Target} {
+				if s == "" && name == "target" {
+					continue
+				}
+				r, ok := new(big.Rat).SetString(s)
+				if !ok || r.Sign() < 0 {
+					return fmt.Errorf("%s %s: invalid %s %q", w.Name, t.Asset, name, s)
+				}
+				amounts[name] = r
+			}
+			if amounts["floor"].Cmp(amounts["ceiling"]) > 0 {
+				return fmt.Errorf("%s %s: floor above ceiling", w.Name, t.Asset)
+			}
+			if target := amounts["target"]; target != nil && (target.Cmp(amounts["floor"]) < 0 || target.Cmp(amounts["ceiling"]) > 0) {
+				return fmt.Errorf("%s %s: target %s outside [%s, %s]", w.Name, t.Asset, t.Target, t.Floor, t.Ceiling)
+			}
+		}
+	}
+	return nil
+}
+
+// rebalance moves the excess of asset t of w above its ceiling to cold
+// through s, and returns a refill request if it is below its floor. nonces
+// holds the next nonce of cold by network.
+func (c *rebalanceCommand) rebalance(s *scanner, ch *chain, cold common.Address, w hotWallet, t walletTarget, balances []balance, nonces map[string]uint64) (*refillRequest, error) {
+	var token *common.Address
+	var erc20 *ERC20Caller
+	info := tokenInfo{name: "Ether", symbol: "ETH", decimals: 18}
+	if !strings.EqualFold(t.Asset, "ETH") {
+		if !common.IsHexAddress(t.Asset) {
+			return nil, fmt.Errorf("asset must be ETH or a token address")
+		}
+		addr := common.HexToAddress(t.Asset)
+		var err error
+		if erc20, err = NewERC20Caller(addr, ch.client); err != nil {
+			return nil, err
+		}
+		token = &addr
+		info = ch.tokenInfo(addr, erc20)
+	}
+
+	var bal *big.Int
+	var b *balance
+	for i := range balances {
+		if balances[i].networkId.Cmp(ch.networkId) == 0 && balances[i].account == w.Address &&
+			(token == nil && balances[i].token == nil || token != nil && balances[i].token != nil && *balances[i].token == *token) {
+			b = &balances[i]
+			bal = b.amount
+		}
+	}
+	if bal == nil {
+		// The wallet was not scanned or its balance could not be read,
+		// read it now rather than taking it for empty.
+		var err error
+		if token == nil {
+			bal, err = ch.client.BalanceAt(ctx, w.Address, nil)
+		} else {
+			bal, err = erc20.BalanceOf(nil, w.Address)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading the balance of %s: %v", w.Address.Hex(), redactError(err, ch.url))
+		}
+	}
+
+	floor, err := parseAmount(t.Floor, info.decimals)
+	if err != nil {
+		return nil, err
+	}
+	ceiling, err := parseAmount(t.Ceiling, info.decimals)
+	if err != nil {
+		return nil, err
+	}
+	if floor.Cmp(ceiling) > 0 {
+		return nil, fmt.Errorf("floor above ceiling")
+	}
+	target := new(big.Int).Add(floor, ceiling)
+	target.Rsh(target, 1)
+	if t.Target != "" {
+		if target, err = parseAmount(t.Target, info.decimals); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case bal.Cmp(ceiling) > 0:
+		if b == nil || b.key == nil {
+			return nil, fmt.Errorf("no key for %s", w.Address.Hex())
+		}
+		excess := new(big.Int).Sub(bal, target)
+		// The fee of an ether move is paid from the wallet, leave it out
+		// of the excess so that the wallet ends at its target.
+		var gasPrice, fee *big.Int
+		if token == nil {
+			gasPrice = suggestGasPrice(ctx, ch.client)
+			fee = new(big.Int).Mul(gasPrice, big.NewInt(21000))
+			if excess.Sub(excess, fee).Sign() <= 0 {
+				log.Printf("%s %s: %s above ceiling %s, the excess does not cover the fee %s", w.Name, info.symbol, formatUnits(bal, info.decimals), t.Ceiling, formatUnits(fee, info.decimals))
+				return nil, nil
+			}
+		}
+		log.Printf("%s %s: %s above ceiling %s, moving %s to cold", w.Name, info.symbol, formatUnits(bal, info.decimals), t.Ceiling, formatUnits(excess, info.decimals))
+		audit("plan", map[string]string{"network_id": ch.networkId.String(), "from": w.Address.Hex(), "to": cold.Hex(), "asset": t.Asset, "value": excess.String(), "reason": "above ceiling"})
+		if c.DryRun {
+			return nil, nil
+		}
+		s.sweep([]sweepIntent{s.intent(ch, w.Address, token, excess, fee)}, func() {
+			if token == nil {
+				sendEther(ctx, ch.client, b.key, cold, excess, gasPrice, big.NewInt(21000), ch.networkId)
+			} else {
+				SwipeToERC20(ctx, ch.client, *token, b.key, cold, excess, ch.networkId)
+			}
+		})
+	case bal.Cmp(floor) < 0:
+		deficit := new(big.Int).Sub(target, bal)
+		log.Printf("%s %s: %s below floor %s, requesting %s from cold", w.Name, info.symbol, formatUnits(bal, info.decimals), t.Floor, formatUnits(deficit, info.decimals))
+		tx := unsignedTx{From: cold, To: w.Address, Value: (*hexutil.Big)(deficit), ChainId: (*hexutil.Big)(ch.networkId)}
+		if token != nil {
+			parsed, err := abi.JSON(strings.NewReader(ERC20ABI))
+			if err != nil {
+				return nil, err
+			}
+			if tx.Data, err = parsed.Pack("transfer", w.Address, deficit); err != nil {
+				return nil, err
+			}
+			tx.To, tx.Value = *token, (*hexutil.Big)(new(big.Int))
+		}
+		tx.GasPrice = (*hexutil.Big)(suggestGasPrice(ctx, ch.client))
+		to := tx.To
+		gas, err := ch.client.EstimateGas(ctx, ethereum.CallMsg{From: cold, To: &to, Value: tx.Value.ToInt(), Data: tx.Data})
+		if err != nil {
+			return nil, fmt.Errorf("estimating the gas of the refill: %v", redactError(err, ch.url))
+		}
+		tx.Gas = hexutil.Uint64(gas)
+		nonce, ok := nonces[ch.networkId.String()]
+		if !ok {
+			if nonce, err = ch.client.NonceAt(ctx, cold, nil); err != nil {
+				return nil, fmt.Errorf("reading the nonce of %s: %v", cold.Hex(), redactError(err, ch.url))
+			}
+		}
+		nonces[ch.networkId.String()] = nonce + 1
+		tx.Nonce = hexutil.Uint64(nonce)
+		return &refillRequest{
+			Wallet:    w.Name,
+			NetworkId: ch.networkId.String(),
+			Address:   w.Address,
+			Asset:     info.symbol,
+			Balance:   formatUnits(bal, info.decimals),
+			Floor:     t.Floor,
+			Amount:    formatUnits(deficit, info.decimals),
+			Tx:        tx,
+		}, nil
+	}
+	return nil, nil
+}
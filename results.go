@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	_ "modernc.org/sqlite"
+)
+
+// resultsSchema is the schema of the results database. Raw amounts are
+// stored as decimal strings since they do not fit an integer column,
+// amount and value are approximations for sorting and charts. run_block is
+// the block of the network when the run started, the balances being read at
+// the latest block while it runs.
+const resultsSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY,
+	started TEXT NOT NULL,
+	finished TEXT
+);
+CREATE TABLE IF NOT EXISTS balances (
+	id INTEGER PRIMARY KEY,
+	run_id INTEGER NOT NULL REFERENCES runs(id),
+	time TEXT NOT NULL,
+	network_id TEXT NOT NULL,
+	run_block INTEGER,
+	account TEXT NOT NULL,
+	asset TEXT NOT NULL,
+	symbol TEXT NOT NULL,
+	decimals INTEGER NOT NULL,
+	balance TEXT NOT NULL,
+	amount REAL NOT NULL,
+	value REAL
+);
+CREATE INDEX IF NOT EXISTS balances_account ON balances (account, network_id, asset);
+CREATE INDEX IF NOT EXISTS balances_time ON balances (time);
+CREATE TABLE IF NOT EXISTS transactions (
+	id INTEGER PRIMARY KEY,
+	time TEXT NOT NULL,
+	network_id TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	account TEXT NOT NULL,
+	asset TEXT NOT NULL,
+	tx_hash TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS transactions_account ON transactions (account);
+CREATE TABLE IF NOT EXISTS deposits (
+	id TEXT PRIMARY KEY,
+	time TEXT NOT NULL,
+	network_id TEXT NOT NULL,
+	customer TEXT NOT NULL,
+	account TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	asset TEXT NOT NULL,
+	amount TEXT NOT NULL,
+	block INTEGER NOT NULL,
+	tx_hash TEXT NOT NULL,
+	log_index INTEGER NOT NULL,
+	screening TEXT NOT NULL,
+	reversed INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS deposits_customer ON deposits (customer);
+`
+
+// resultsTime is the format of the times of the results database, the one
+// of the SQLite date functions.
+const resultsTime = "2006-01-02 15:04:05"
+
+// holding identifies the balance of an asset of an account.
+type holding struct {
+	networkId string
+	account   common.Address
+	asset     string
+}
+
+// resultsDB is a SQLite database of the scans, transactions and deposits.
+// Only the non-zero balances are stored, plus a zero balance when a
+// balance stored as non-zero is found empty.
+type resultsDB struct {
+	db *sql.DB
+
+	mu   sync.Mutex
+	held map[holding]bool
+}
+
+// results is the results database of the process, nil when disabled.
+var results *resultsDB
+
+// resultsRun is a scan stored in the results database.
+type resultsRun struct {
+	id     int64
+	blocks map[string]uint64
+}
+
+// openResults opens or creates the results database at path.
+func openResults(path string) (*resultsDB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite has a single writer, serialize the scan workers here rather
+	// than failing with SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000", resultsSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	r := &resultsDB{db: db, held: make(map[holding]bool)}
+	rows, err := db.Query(`SELECT b.network_id, b.account, b.asset FROM balances b
+		JOIN (SELECT MAX(id) AS id FROM balances GROUP BY network_id, account, asset) l ON b.id = l.id
+		WHERE b.balance != '0'`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h holding
+		var account string
+		if err := rows.Scan(&h.networkId, &account, &h.asset); err != nil {
+			db.Close()
+			return nil, err
+		}
+		h.account = common.HexToAddress(account)
+		r.held[h] = true
+	}
+	return r, rows.Err()
+}
+
+func resultsNow() string {
+	return time.Now().UTC().Format(resultsTime)
+}
+
+// beginRun records the start of a scan of chains and their current block.
+func (r *resultsDB) beginRun(ctx context.Context, chains []*chain) (*resultsRun, error) {
+	res, err := r.db.Exec("INSERT INTO runs (started) VALUES (?)", resultsNow())
+	if err != nil {
+		return nil, err
+	}
+	run := &resultsRun{blocks: make(map[string]uint64)}
+	if run.id, err = res.LastInsertId(); err != nil {
+		return nil, err
+	}
+	for _, ch := range chains {
+		block, err := ch.client.BlockNumber(ctx)
+		if err != nil {
+			log.Printf("Network %s: %v", ch.networkId, redactError(err, ch.url))
+			continue
+		}
+		run.blocks[ch.networkId.String()] = block
+	}
+	return run, nil
+}
+
+// endRun records the end of run.
+func (r *resultsDB) endRun(run *resultsRun) error {
+	_, err := r.db.Exec("UPDATE runs SET finished = ? WHERE id = ?", resultsNow(), run.id)
+	return err
+}
+
+// balance stores the balance of an asset of an account found by run.
+// price is the value of a unit of the asset, nil if unknown.
+func (r *resultsDB) balance(run *resultsRun, networkId string, account common.Address, asset string, info tokenInfo, amount *big.Int, price *big.Rat) error {
+	var block sql.NullInt64
+	if n, ok := run.blocks[networkId]; ok {
+		block = sql.NullInt64{Int64: int64(n), Valid: true}
+	}
+	units := amountRat(amount, info.decimals)
+	fAmount, _ := units.Float64()
+	var value sql.NullFloat64
+	if price != nil {
+		value.Float64, _ = new(big.Rat).Mul(units, price).Float64()
+		value.Valid = true
+	}
+	_, err := r.db.Exec(`INSERT INTO balances (run_id, time, network_id, run_block, account, asset, symbol, decimals, balance, amount, value)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		run.id, resultsNow(), networkId, block, account.Hex(), asset, info.symbol, info.decimals, amount.String(), fAmount, value)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.held[holding{networkId: networkId, account: account, asset: asset}] = amount.Sign() != 0
+	r.mu.Unlock()
+	return nil
+}
+
+// holds reports whether the last balance stored for the asset of account
+// is non-zero.
+func (r *resultsDB) holds(networkId string, account common.Address, asset string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.held[holding{networkId: networkId, account: account, asset: asset}]
+}
+
+// recordTransaction stores a transaction sent for account in the results
+// database if enabled.
+func recordTransaction(networkId string, account common.Address, kind, asset string, tx common.Hash) {
+	if results == nil || tx == (common.Hash{}) {
+		return
+	}
+	_, err := results.db.Exec("INSERT INTO transactions (time, network_id, kind, account, asset, tx_hash) VALUES (?, ?, ?, ?, ?, ?)",
+		resultsNow(), networkId, kind, account.Hex(), asset, tx.Hex())
+	if err != nil {
+		log.Printf("Results database: %v", err)
+	}
+}
+
+// recordDeposit stores a credited deposit in the results database if
+// enabled.
+func recordDeposit(e *ledgerEntry) {
+	if results == nil {
+		return
+	}
+	_, err := results.db.Exec(`INSERT OR REPLACE INTO deposits (id, time, network_id, customer, account, sender, asset, amount, block, tx_hash, log_index, screening)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Id, e.Time.UTC().Format(resultsTime), e.NetworkId, e.Customer, e.Account.Hex(), e.From.Hex(), e.Asset, e.Amount, e.Block, e.TxHash.Hex(), e.LogIndex, e.Screening)
+	if err != nil {
+		log.Printf("Results database: %v", err)
+	}
+}
+
+// recordReversal marks a deposit reversed in the results database if
+// enabled.
+func recordReversal(id string) {
+	if results == nil {
+		return
+	}
+	if _, err := results.db.Exec("UPDATE deposits SET reversed = 1 WHERE id = ?", id); err != nil {
+		log.Printf("Results database: %v", err)
+	}
+}
+
+func (r *resultsDB) Close() error {
+	return r.db.Close()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/gorilla/websocket"
+)
+
+// rpcEndpoint holds the connection settings of the urls starting with URL.
+type rpcEndpoint struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Bearer  string            `json:"bearer"`
+	// Username and Password are sent with basic auth.
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// ClientCert and ClientKey are the PEM files of the mTLS client
+	// certificate, CACert the PEM file of the trusted server CAs.
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+	CACert     string `json:"ca_cert"`
+	// Proxy is an http, https or socks5 proxy url.
+	Proxy string `json:"proxy"`
+}
+
+// rpcEndpoints are the settings of --rpc-config.
+var rpcEndpoints []rpcEndpoint
+
+// loadRPCConfig reads a JSON list of rpcEndpoint.
+func loadRPCConfig(path string) ([]rpcEndpoint, error) {
+	data, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []rpcEndpoint
+	if err := json.Unmarshal(data, &endpoints); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return endpoints, nil
+}
+
+// endpointFor returns the settings of the longest URL prefix of u.
+func endpointFor(u string) *rpcEndpoint {
+	var best *rpcEndpoint
+	for i := range rpcEndpoints {
+		e := &rpcEndpoints[i]
+		if strings.HasPrefix(u, e.URL) && (best == nil || len(e.URL) > len(best.URL)) {
+			best = e
+		}
+	}
+	return best
+}
+
+// dialRPC connects to u with the headers, credentials, client certificate
+// and proxy of its --rpc-config endpoint.
+func dialRPC(ctx context.Context, u string) (*rpc.Client, error) {
+	e := endpointFor(u)
+	if e == nil {
+		c, err := rpc.DialContext(ctx, u)
+		return c, redactError(err, u)
+	}
+	headers := make(http.Header)
+	for k, v := range e.Headers {
+		headers.Set(k, v)
+	}
+	switch {
+	case e.Bearer != "":
+		headers.Set("Authorization", "Bearer "+e.Bearer)
+	case e.Username != "":
+		headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(e.Username+":"+e.Password)))
+	}
+	tlsConfig := &tls.Config{}
+	if e.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(e.ClientCert, e.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if e.CACert != "" {
+		pem, err := readFile(e.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificate", e.CACert)
+		}
+	}
+	proxy := http.ProxyFromEnvironment
+	if e.Proxy != "" {
+		proxyURL, err := url.Parse(e.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy of %s: %v", redactURL(u), redactError(err, e.Proxy))
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.Proxy = proxy
+	c, err := rpc.DialOptions(ctx, u,
+		rpc.WithHeaders(headers),
+		rpc.WithHTTPClient(&http.Client{Transport: transport}),
+		rpc.WithWebsocketDialer(websocket.Dialer{
+			Proxy:            proxy,
+			TLSClientConfig:  tlsConfig,
+			HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+		}),
+	)
+	return c, redactError(err, u)
+}
+
+// dialEthClient is dialRPC returning an ethclient.
+func dialEthClient(ctx context.Context, u string) (*ethclient.Client, error) {
+	c, err := dialRPC(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	return ethclient.NewClient(c), nil
+}
+
+// apiKeySegment matches the path segments holding API keys, such as
+// /v3/KEY or /v2/KEY.
+var apiKeySegment = regexp.MustCompile(`^[A-Za-z0-9_-]{16,}$`)
+
+// redactURL hides the password, the query values and the path segments
+// looking like API keys of u.
+func redactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Host == "" {
+		// IPC paths and unparsable urls are left untouched.
+		return u
+	}
+	if parsed.User != nil {
+		parsed.User = url.User("***")
+	}
+	if parsed.RawQuery != "" {
+		query := parsed.Query()
+		for k := range query {
+			query.Set(k, "***")
+		}
+		parsed.RawQuery = query.Encode()
+	}
+	segments := strings.Split(parsed.Path, "/")
+	for i, segment := range segments {
+		if apiKeySegment.MatchString(segment) {
+			segments[i] = "***"
+		}
+	}
+	parsed.Path = strings.Join(segments, "/")
+	parsed.RawPath = ""
+	return strings.Replace(parsed.String(), "%2A%2A%2A", "***", -1)
+}
+
+// urlPattern matches the urls of an error message, as printed by net/http
+// with the password already hidden or quoted by net/url.
+var urlPattern = regexp.MustCompile(`[A-Za-z][A-Za-z0-9+.-]*://[^\s"'<>]+`)
+
+// redactedError is an error whose message has its urls redacted.
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError replaces u, which may be an IPC path, and every url of err by
+// their redacted form.
+func redactError(err error, u string) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	if u != "" {
+		msg = strings.Replace(msg, u, redactURL(u), -1)
+	}
+	msg = urlPattern.ReplaceAllStringFunc(msg, func(match string) string {
+		found := strings.TrimRight(match, ".,;:)]")
+		return redactURL(found) + match[len(found):]
+	})
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{msg: msg, err: err}
+}
+
+// redactRPCError redacts every rpc, bundler and paymaster url from err, for
+// the errors of calls that do not know which url they went to.
+func redactRPCError(err error) error {
+	for _, u := range opts.RPCURLs {
+		err = redactError(err, u)
+	}
+	for _, u := range append(append([]string{}, opts.BundlerURLs...), opts.PaymasterURLs...) {
+		_, u = splitNetworkURL(u)
+		err = redactError(err, u)
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/node"
+)
+
+// sandboxChainId is the chain and network id of the sandbox chain.
+const sandboxChainId = 1337
+
+// sandboxTokens are the sample tokens of the sandbox chain, deployed in its
+// genesis at sandboxTokenAddress(i).
+var sandboxTokens = []sandboxToken{
+	{name: "Sandbox Dollar", symbol: "SBD", decimals: 6},
+	{name: "No Return Dollar", symbol: "NRD", decimals: 6, noReturn: true},
+	{name: "Fee On Transfer", symbol: "FOT", decimals: 18, fee: true},
+	{name: "Bytes32 Token", symbol: "B32", decimals: 18, bytes32: true},
+}
+
+func sandboxTokenAddress(i int) common.Address {
+	return common.HexToAddress(fmt.Sprintf("0x5a%038x", i+1))
+}
+
+// tokenBalanceSlot returns the storage slot of the balance of addr in a
+// sandboxToken.
+func tokenBalanceSlot(addr common.Address) common.Hash {
+	return crypto.Keccak256Hash(common.LeftPadBytes(addr.Bytes(), 32), common.LeftPadBytes([]byte{1}, 32))
+}
+
+type sandboxCommand struct {
+	Port      int           `long:"port" default:"8545" description:"Local port of the HTTP RPC endpoint, the WebSocket one is the next port"`
+	Keys      int           `long:"keys" default:"5" description:"Number of funded keys generated"`
+	BlockTime time.Duration `long:"block-time" default:"2s" description:"Delay between two blocks"`
+	KeyFile   string        `long:"key-file" description:"Write the generated keys to this file instead of printing them"`
+}
+
+func (c *sandboxCommand) Execute(args []string) error {
+	if c.Keys < 1 {
+		return fmt.Errorf("--keys must be at least 1")
+	}
+	ether := new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+	alloc := make(types.GenesisAlloc)
+	var keys []string
+	var holders []common.Address
+	for i := 0; i < c.Keys; i++ {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			return err
+		}
+		addr := crypto.PubkeyToAddress(key.PublicKey)
+		keys = append(keys, encodeKey(key))
+		holders = append(holders, addr)
+		// Every other key has no ether, so that its tokens can not pay
+		// for their own sweep.
+		balance := new(big.Int)
+		if i%2 == 0 {
+			balance.Mul(big.NewInt(int64(i+1)), ether)
+		}
+		alloc[addr] = types.Account{Balance: balance}
+	}
+	swipeKey, err := crypto.GenerateKey()
+	if err != nil {
+		return err
+	}
+	swipeTo := crypto.PubkeyToAddress(swipeKey.PublicKey)
+
+	var contracts []string
+	for i, t := range sandboxTokens {
+		unit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(t.decimals)), nil)
+		storage := make(map[common.Hash]common.Hash)
+		supply := new(big.Int)
+		for j, holder := range holders {
+			amount := new(big.Int).Mul(big.NewInt(int64(1000*(j+1))), unit)
+			storage[tokenBalanceSlot(holder)] = common.BigToHash(amount)
+			supply.Add(supply, amount)
+		}
+		storage[common.Hash{}] = common.BigToHash(supply)
+		addr := sandboxTokenAddress(i)
+		alloc[addr] = types.Account{Code: t.code(), Storage: storage, Balance: new(big.Int)}
+		contracts = append(contracts, addr.Hex())
+	}
+
+	sim := simulated.NewBackend(alloc, func(nodeConf *node.Config, ethConf *ethconfig.Config) {
+		nodeConf.HTTPHost = "127.0.0.1"
+		nodeConf.HTTPPort = c.Port
+		nodeConf.HTTPModules = []string{"eth", "net", "web3"}
+		nodeConf.WSHost = "127.0.0.1"
+		nodeConf.WSPort = c.Port + 1
+		nodeConf.WSModules = []string{"eth", "net", "web3"}
+		ethConf.NetworkId = sandboxChainId
+	})
+	defer sim.Close()
+	go func() {
+		ticker := time.NewTicker(c.BlockTime)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sim.Commit()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	log.Printf("Sandbox chain %d on http://127.0.0.1:%d and ws://127.0.0.1:%d, a block every %s", sandboxChainId, c.Port, c.Port+1, c.BlockTime)
+	for i, t := range sandboxTokens {
+		kind := "standard"
+		switch {
+		case t.noReturn:
+			kind = "no return value"
+		case t.fee:
+			kind = "1% fee on transfer"
+		case t.bytes32:
+			kind = "bytes32 name and symbol"
+		}
+		fmt.Printf("%s [%s]: %s, %d decimals, %s\n", t.name, sandboxTokenAddress(i).Hex(), t.symbol, t.decimals, kind)
+	}
+	for i, holder := range holders {
+		fmt.Printf("%s: %s\n", holder.Hex(), keys[i])
+	}
+	fmt.Printf("Swipe address %s: %s\n", swipeTo.Hex(), encodeKey(swipeKey))
+
+	invocation := []string{os.Args[0], fmt.Sprintf("--rpc-url=http://127.0.0.1:%d", c.Port)}
+	for _, contract := range contracts {
+		invocation = append(invocation, "--contract-address="+contract)
+	}
+	if c.KeyFile != "" {
+		if err := writeFile(c.KeyFile, []byte(strings.Join(keys, "\n")+"\n")); err != nil {
+			return err
+		}
+		invocation = append(invocation, "--key-file="+c.KeyFile)
+	} else {
+		for _, key := range keys {
+			invocation = append(invocation, "--private-key="+key)
+		}
+	}
+	invocation = append(invocation, "--swipe-address="+swipeTo.Hex())
+	fmt.Printf("\nTry:\n  %s\n", strings.Join(invocation, " "))
+
+	<-ctx.Done()
+	return nil
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// tokenInfo is the metadata of an ERC20 contract as returned by getERC20Info.
+type tokenInfo struct {
+	name     string
+	symbol   string
+	decimals uint
+}
+
+// chain is a connected Ethereum client.
+type chain struct {
+	url       string
+	client    *ethclient.Client
+	networkId *big.Int
+
+	mu     sync.Mutex
+	tokens map[common.Address]tokenInfo
+}
+
+// dialChains connects to every rpc url, skipping the unreachable ones.
+func dialChains(ctx context.Context, rpcUrls []string) []*chain {
+	var chains []*chain
+	for _, rpcUrl := range rpcUrls {
+		c, err := dialEthClient(ctx, rpcUrl)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		networkId, err := c.NetworkID(ctx)
+		if err != nil {
+			log.Printf("Network id of %s: %v", redactURL(rpcUrl), redactError(err, rpcUrl))
+			continue
+		}
+
+		log.Printf("Connected to %v [network id: %s]", redactURL(rpcUrl), networkId)
+		chains = append(chains, &chain{
+			url:       rpcUrl,
+			client:    c,
+			networkId: networkId,
+			tokens:    make(map[common.Address]tokenInfo),
+		})
+	}
+	return chains
+}
+
+// tokenInfo returns the cached metadata of the ERC20 contract at addr.
+func (ch *chain) tokenInfo(addr common.Address, erc20 *ERC20Caller) tokenInfo {
+	info, err := ch.readTokenInfo(addr, erc20)
+	check(err)
+	return info
+}
+
+// readTokenInfo is tokenInfo returning the error of reading the metadata.
+func (ch *chain) readTokenInfo(addr common.Address, erc20 *ERC20Caller) (tokenInfo, error) {
+	ch.mu.Lock()
+	info, ok := ch.tokens[addr]
+	ch.mu.Unlock()
+	if ok {
+		return info, nil
+	}
+	name, symbol, decimals, err := readERC20Info(erc20)
+	if err != nil {
+		return tokenInfo{}, fmt.Errorf("token %s: %v", addr.Hex(), err)
+	}
+	info = tokenInfo{name: name, symbol: symbol, decimals: decimals}
+	ch.mu.Lock()
+	ch.tokens[addr] = info
+	ch.mu.Unlock()
+	return info, nil
+}
+
+// account is a scanned address, watch-only when key is nil. Accounts with
+// an owner are ERC-4337 smart accounts and accounts with a salt are CREATE2
+// forwarders.
+type account struct {
+	address common.Address
+	key     *ecdsa.PrivateKey
+	owner   *ecdsa.PrivateKey
+	salt    *[32]byte
+}
+
+func keyAccount(key *ecdsa.PrivateKey) account {
+	return account{address: crypto.PubkeyToAddress(key.PublicKey), key: key}
+}
+
+// balance is a non-zero balance found by a scan, of ether when token is nil.
+// key is the key of the account, nil if watch-only.
+type balance struct {
+	networkId *big.Int
+	account   common.Address
+	key       *ecdsa.PrivateKey
+	token     *common.Address
+	info      tokenInfo
+	amount    *big.Int
+}
+
+// scanner scans accounts against chains.
+type scanner struct {
+	chains            []*chain
+	contractAddresses []common.Address
+	swipeTo           common.Address
+	// operator, if set with swipeTo, flushes the forwarders.
+	operator *ecdsa.PrivateKey
+	workers  int
+	w        io.Writer
+	progress *progress
+
+	// onBalance, if set, is called with every balance found. Calls are
+	// serialized.
+	onBalance func(balance)
+	// onAccount, if set, is called once an account is scanned on a chain,
+	// with the first error reading one of its balances. Calls are
+	// serialized.
+	onAccount func(ch *chain, addr common.Address, err error)
+	// visit, if set, replaces the balance scan of every account. Its
+	// output is written to w at once.
+	visit func(ctx context.Context, ch *chain, acc account, w io.Writer)
+	// stored is the run of the results database, nil when disabled.
+	stored *resultsRun
+	mu     sync.Mutex
+	// deferred are the sweeps held until the circuit breaker passes.
+	deferred []deferredSweep
+}
+
+// deferredSweep is a sweep held by the circuit breaker.
+type deferredSweep struct {
+	intents []sweepIntent
+	run     func()
+}
+
+// intent returns the sweep intent of amount of token, ether if nil, from
+// acc on ch.
+func (s *scanner) intent(ch *chain, from common.Address, token *common.Address, amount, fee *big.Int) sweepIntent {
+	in := sweepIntent{networkId: ch.networkId, account: from, asset: "ETH", symbol: "ETH", decimals: 18, amount: amount, fee: fee}
+	if token != nil {
+		info := ch.tokenInfo(*token, mustERC20Caller(*token, ch))
+		in.asset, in.symbol, in.decimals = token.Hex(), info.symbol, info.decimals
+	}
+	if p := s.price(ch, token, in.symbol); p != nil {
+		in.value = new(big.Rat).Mul(amountRat(amount, in.decimals), p)
+	}
+	if fee != nil {
+		if p := s.price(ch, nil, "ETH"); p != nil {
+			in.feeValue = new(big.Rat).Mul(amountRat(fee, 18), p)
+		}
+	}
+	return in
+}
+
+// sweep runs a sweep, or holds it until the end of the scan when the
+// circuit breaker is enabled.
+func (s *scanner) sweep(intents []sweepIntent, run func()) {
+	for _, in := range intents {
+		publishPlanned(in)
+	}
+	if circuit == nil {
+		run()
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deferred = append(s.deferred, deferredSweep{intents: intents, run: run})
+}
+
+// flush runs the held sweeps if the circuit breaker passes.
+func (s *scanner) flush() error {
+	if len(s.deferred) == 0 {
+		return nil
+	}
+	var intents []sweepIntent
+	for _, d := range s.deferred {
+		intents = append(intents, d.intents...)
+	}
+	if err := circuit.evaluate(intents); err != nil {
+		return err
+	}
+	for _, d := range s.deferred {
+		d.run()
+	}
+	s.deferred = nil
+	return nil
+}
+
+// accountIntents returns the intents of sweeping tokens and value from
+// an account whose fees are paid by someone else.
+func (s *scanner) accountIntents(ch *chain, from common.Address, tokens []tokenBalance, value *big.Int) []sweepIntent {
+	var intents []sweepIntent
+	for _, t := range tokens {
+		token := t.token
+		intents = append(intents, s.intent(ch, from, &token, t.amount, nil))
+	}
+	if value.Sign() != 0 {
+		intents = append(intents, s.intent(ch, from, nil, value, nil))
+	}
+	return intents
+}
+
+func (s *scanner) found(b balance) {
+	publishBalance(b)
+	if s.onBalance == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onBalance(b)
+}
+
+func (s *scanner) scanned(ch *chain, addr common.Address, err error) {
+	if s.onAccount == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onAccount(ch, addr, err)
+}
+
+// record stores a balance of an account in the results database, if
+// enabled. Zero balances are only stored when they empty a stored balance.
+func (s *scanner) record(ch *chain, from common.Address, token *common.Address, amount *big.Int) {
+	if s.stored == nil {
+		return
+	}
+	networkId := ch.networkId.String()
+	asset := "ETH"
+	if token != nil {
+		asset = token.Hex()
+	}
+	if amount.Sign() == 0 && !results.holds(networkId, from, asset) {
+		return
+	}
+	info := tokenInfo{name: "Ether", symbol: "ETH", decimals: 18}
+	if token != nil {
+		info = ch.tokenInfo(*token, mustERC20Caller(*token, ch))
+	}
+	if err := results.balance(s.stored, networkId, from, asset, info, amount, s.price(ch, token, info.symbol)); err != nil {
+		log.Printf("Results database: %v", err)
+	}
+}
+
+// price returns the price of an asset for the value column, nil if there
+// is no pricer or the asset can not be priced.
+func (s *scanner) price(ch *chain, token *common.Address, symbol string) *big.Rat {
+	if pricer == nil {
+		return nil
+	}
+	p, err := pricer.price(ch, token, symbol)
+	if err != nil {
+		log.Printf("Network %s: %v", ch.networkId, redactError(err, ch.url))
+		return nil
+	}
+	return p
+}
+
+// scanAccount prints the non-zero balances of acc on ch and swipes ether if
+// swipeTo is set and acc has a key.
+func (s *scanner) scanAccount(ctx context.Context, ch *chain, acc account) {
+	var buf bytes.Buffer
+	defer func() {
+		if buf.Len() > 0 {
+			s.w.Write(buf.Bytes())
+		}
+	}()
+
+	from := acc.address
+	var scanErr error
+	defer func() {
+		s.scanned(ch, from, scanErr)
+	}()
+	if len(claimers) > 0 {
+		// Claim first so that the balances include the claimed funds.
+		send := s.swipeTo != *new(common.Address) && acc.key != nil && acc.owner == nil && acc.salt == nil && !screen.isQuarantined(from) && halted() == nil
+		s.claimAll(ctx, ch, acc, &buf, send)
+	}
+	var tokens []tokenBalance
+	for _, contractAddr := range s.contractAddresses {
+		erc20, err := NewERC20Caller(contractAddr, ch.client)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		bal, err := erc20.BalanceOf(&bind.CallOpts{Context: ctx}, from)
+		if err != nil {
+			err = redactError(err, ch.url)
+			log.Printf("Network %s: %s: %s: %v", ch.networkId, from.Hex(), contractAddr.Hex(), err)
+			if scanErr == nil {
+				scanErr = fmt.Errorf("%s: %v", contractAddr.Hex(), err)
+			}
+			continue
+		}
+		token := contractAddr
+		s.record(ch, from, &token, bal)
+		if bal.Cmp(&big.Int{}) == 0 {
+			continue
+		}
+		info := ch.tokenInfo(contractAddr, erc20)
+		fmt.Fprintf(&buf, "%v [%v]: \n", info.name, contractAddr.String())
+		printAccount(&buf, from, info.symbol, info.decimals, bal, s.price(ch, &contractAddr, info.symbol))
+		s.found(balance{networkId: ch.networkId, account: from, key: acc.key, token: &token, info: info, amount: bal})
+		tokens = append(tokens, tokenBalance{token: contractAddr, amount: bal})
+		// Do not swipe tokens…
+		//if s.swipeTo != *new(common.Address) {
+		//	SwipeToERC20(ctx, ch.client, contractAddr, acc.key, s.swipeTo, bal, ch.networkId)
+		//}
+	}
+	bal, err := ch.client.BalanceAt(ctx, from, nil)
+	if err != nil {
+		log.Printf("Network %s: %s: %v", ch.networkId, from.Hex(), redactError(err, ch.url))
+		scanErr = redactError(err, ch.url)
+		return
+	}
+	sweep := s.swipeTo != *new(common.Address)
+	if sweep && screen.isQuarantined(from) && (len(tokens) > 0 || bal.Sign() != 0) {
+		screen.hit(screeningHit{kind: "sweep skipped", address: from, detail: "quarantined account"})
+		fmt.Fprintf(&buf, "%s is quarantined, not swept\n", from.Hex())
+		sweep = false
+	}
+	if sweep && (len(tokens) > 0 || bal.Sign() != 0) {
+		if err := halted(); err != nil {
+			fmt.Fprintf(&buf, "%s not swept: %v\n", from.Hex(), err)
+			sweep = false
+		}
+	}
+	name, unit, dec := getERC20Info(ch.client, nil)
+	s.record(ch, from, nil, bal)
+	if sweep && acc.salt != nil && s.operator != nil && (len(tokens) > 0 || bal.Sign() != 0) {
+		audit("plan", map[string]string{"network_id": ch.networkId.String(), "from": from.Hex(), "asset": "forwarder", "balance": bal.String(), "tokens": fmt.Sprint(len(tokens))})
+		s.sweep(s.accountIntents(ch, from, tokens, bal), func() {
+			if err := SwipeForwarder(ctx, ch, s.operator, from, *acc.salt, tokens, bal); err != nil {
+				log.Printf("Forwarder %s: %v", from.Hex(), redactError(err, ch.url))
+				publishFailed(ch.networkId, from, "forwarder", err)
+			}
+		})
+	}
+	if sweep && acc.owner != nil && s.swipeTo != *new(common.Address) && (len(tokens) > 0 || bal.Sign() != 0) {
+		audit("plan", map[string]string{"network_id": ch.networkId.String(), "from": from.Hex(), "to": s.swipeTo.Hex(), "asset": "smart account", "balance": bal.String(), "tokens": fmt.Sprint(len(tokens))})
+		s.sweep(s.accountIntents(ch, from, tokens, bal), func() {
+			if err := SwipeSmartAccount(ctx, ch, from, acc.owner, s.swipeTo, tokens, bal); err != nil {
+				log.Printf("Smart account %s: %v", from.Hex(), redactRPCError(err))
+				publishFailed(ch.networkId, from, "smart account", err)
+			}
+		})
+	}
+	if bal.Cmp(&big.Int{}) != 0 {
+		printAccount(&buf, from, unit, dec, bal, s.price(ch, nil, unit))
+		s.found(balance{networkId: ch.networkId, account: from, key: acc.key, info: tokenInfo{name: name, symbol: unit, decimals: dec}, amount: bal})
+		if sweep && s.swipeTo != *new(common.Address) && acc.key != nil {
+			audit("plan", map[string]string{"network_id": ch.networkId.String(), "from": from.Hex(), "to": s.swipeTo.Hex(), "asset": unit, "balance": bal.String()})
+			fee := new(big.Int).Mul(suggestGasPrice(ctx, ch.client), big.NewInt(21000))
+			if bal.Cmp(fee) <= 0 {
+				fmt.Fprintf(&buf, "%s not swept: balance does not cover the fee of %s %s\n", from.Hex(), formatUnits(fee, dec), unit)
+				return
+			}
+			s.sweep([]sweepIntent{s.intent(ch, from, nil, new(big.Int).Sub(bal, fee), fee)}, func() {
+				// The sweep may be held until the end of the scan, sweep
+				// the balance at that time.
+				bal, err := ch.client.BalanceAt(ctx, from, nil)
+				if err != nil {
+					log.Printf("Network %s: %s: %v", ch.networkId, from.Hex(), redactError(err, ch.url))
+					return
+				}
+				tx := SwipeTo(ctx, ch.client, acc.key, s.swipeTo, bal, ch.networkId)
+				recordSweep(ch, from, "ETH", tx)
+			})
+		}
+	}
+}
+
+// scan scans every account received on accounts against every chain using
+// s.workers concurrent scanners.
+func (s *scanner) scan(ctx context.Context, accounts <-chan account) {
+	var wg sync.WaitGroup
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for acc := range accounts {
+				for _, ch := range s.chains {
+					if s.visit == nil {
+						s.scanAccount(ctx, ch, acc)
+						continue
+					}
+					var buf bytes.Buffer
+					s.visit(ctx, ch, acc, &buf)
+					s.w.Write(buf.Bytes())
+				}
+				s.progress.Done()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// run streams the configured accounts through s.
+func (s *scanner) run(ctx context.Context) error {
+	if results != nil {
+		var err error
+		if s.stored, err = results.beginRun(ctx, s.chains); err != nil {
+			return err
+		}
+		defer func() {
+			if err := results.endRun(s.stored); err != nil {
+				log.Printf("Results database: %v", err)
+			}
+		}()
+	}
+	accounts := make(chan account, s.workers)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- streamAccounts(ctx, s.chains, s.contractAddresses, accounts)
+	}()
+	s.scan(ctx, accounts)
+	if err := <-errc; err != nil {
+		return err
+	}
+	log.Printf("Processed %d keys", s.progress.Total())
+	return s.flush()
+}
+
+// newScanner returns a scanner for the global options, writing to w.
+func newScanner(ctx context.Context, w io.Writer) (*scanner, error) {
+	if len(opts.PrivateKeys) == 0 && len(opts.KeyFiles) == 0 && opts.Mnemonic == "" && len(opts.XPubs) == 0 && len(opts.SmartAccounts) == 0 && len(opts.ForwarderSalts) == 0 {
+		return nil, fmt.Errorf("no account, use --private-key, --key-file, --mnemonic, --xpub, --smart-account or --forwarder-salts")
+	}
+	if len(opts.RPCURLs) == 0 {
+		return nil, fmt.Errorf("no ethereum client, use --rpc-url")
+	}
+	s := &scanner{
+		workers:  opts.Workers,
+		w:        w,
+		progress: &progress{n: opts.Progress},
+	}
+	for _, contractAddr := range opts.ContractAddresses {
+		s.contractAddresses = append(s.contractAddresses, common.HexToAddress(contractAddr))
+	}
+	s.chains = dialChains(ctx, opts.RPCURLs)
+	return s, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// denyEntry is an address of a deny list.
+type denyEntry struct {
+	source string
+	labels []string
+}
+
+// screeningHit is a counterparty found on a deny list.
+type screeningHit struct {
+	kind    string
+	address common.Address
+	account common.Address
+	detail  string
+}
+
+// screening checks counterparties against the deny lists and tracks the
+// quarantined accounts, excluded from automatic sweeps.
+type screening struct {
+	mu          sync.Mutex
+	denied      map[common.Address]denyEntry
+	quarantined map[common.Address]string
+	path        string
+	hits        []screeningHit
+}
+
+// screen is the screening of the process, nil when no deny list is given.
+var screen *screening
+
+// loadScreening reads the deny lists, CSV files of address,source,labels
+// with labels separated by semicolons, and the quarantine file.
+func loadScreening(denyLists []string, quarantine string) (*screening, error) {
+	s := &screening{
+		denied:      make(map[common.Address]denyEntry),
+		quarantined: make(map[common.Address]string),
+		path:        quarantine,
+	}
+	for _, path := range denyLists {
+		err := readCSV(path, func(fields []string) error {
+			if !common.IsHexAddress(fields[0]) {
+				return fmt.Errorf("invalid address %q", fields[0])
+			}
+			e := denyEntry{source: path}
+			if len(fields) > 1 && fields[1] != "" {
+				e.source = fields[1]
+			}
+			if len(fields) > 2 && fields[2] != "" {
+				e.labels = strings.Split(fields[2], ";")
+			}
+			s.denied[common.HexToAddress(fields[0])] = e
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if quarantine != "" {
+		err := readCSV(quarantine, func(fields []string) error {
+			reason := ""
+			if len(fields) > 1 {
+				reason = fields[1]
+			}
+			s.quarantined[common.HexToAddress(fields[0])] = reason
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// readCSV calls fn with the trimmed fields of every line of path, skipping
+// blank lines and # comments. Lines sealed by sealLine are decrypted.
+func readCSV(path string, fn func([]string) error) error {
+	r, err := openFile(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		plain, err := openLine(scanner.Bytes())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		str := string(plain)
+		if str == "" || strings.HasPrefix(str, "#") {
+			continue
+		}
+		fields := strings.Split(str, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if err := fn(fields); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// listed returns the deny list entry of addr, if any.
+func (s *screening) listed(addr common.Address) (denyEntry, bool) {
+	if s == nil {
+		return denyEntry{}, false
+	}
+	e, ok := s.denied[addr]
+	return e, ok
+}
+
+func (e denyEntry) String() string {
+	if len(e.labels) == 0 {
+		return e.source
+	}
+	return e.source + " (" + strings.Join(e.labels, ", ") + ")"
+}
+
+func (s *screening) hit(h screeningHit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hits = append(s.hits, h)
+}
+
+// checkDestination returns an error if funds must not be sent to addr.
+func (s *screening) checkDestination(addr common.Address) error {
+	e, ok := s.listed(addr)
+	if !ok {
+		return nil
+	}
+	s.hit(screeningHit{kind: "destination refused", address: addr, detail: e.String()})
+	return fmt.Errorf("destination %s is on deny list %s", addr.Hex(), e)
+}
+
+// isQuarantined reports whether account is excluded from automatic sweeps.
+func (s *screening) isQuarantined(account common.Address) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.quarantined[account]
+	return ok
+}
+
+// screenDeposit flags a deposit to account from a listed address and
+// quarantines the account. It returns the hit description, empty if the
+// sender is not listed.
+func (s *screening) screenDeposit(account, from common.Address, id string) (string, error) {
+	e, ok := s.listed(from)
+	if !ok {
+		return "", nil
+	}
+	detail := fmt.Sprintf("deposit %s from %s listed by %s", id, from.Hex(), e)
+	s.hit(screeningHit{kind: "deposit flagged", address: from, account: account, detail: detail})
+	return detail, s.quarantine(account, detail)
+}
+
+// quarantine excludes account from automatic sweeps and records it in the
+// quarantine file, encrypted like the ledger when encryption is enabled.
+func (s *screening) quarantine(account common.Address, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.quarantined[account]; ok {
+		return nil
+	}
+	s.quarantined[account] = reason
+	if s.path == "" {
+		return nil
+	}
+	line, err := sealLine([]byte(account.Hex() + "," + strings.Replace(reason, ",", ";", -1)))
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// report writes the screening hits section to w.
+func (s *screening) report(w io.Writer) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.hits) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\nScreening hits:\n")
+	for _, h := range s.hits {
+		if h.account != (common.Address{}) {
+			fmt.Fprintf(w, "%s, %s: %s [account %s]\n", h.kind, h.address.Hex(), h.detail, h.account.Hex())
+		} else {
+			fmt.Fprintf(w, "%s, %s: %s\n", h.kind, h.address.Hex(), h.detail)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	flags "github.com/jessevdk/go-flags"
+	"go.mozilla.org/sops/v3/decrypt"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// secretsOptions are the options needed to load the secrets bundle, parsed
+// before the others.
+type secretsOptions struct {
+	Secrets    string   `env:"SECRETS_FILE" long:"secrets"`
+	Identities []string `env:"IDENTITY" env-delim:"," long:"identity"`
+}
+
+// secretsFdEnv names the environment variable giving a daemon job the file
+// descriptor its secrets bundle is passed on.
+const secretsFdEnv = "SECRETS_FD"
+
+// secrets is the decrypted secrets bundle, nil without one. It is only
+// kept in memory, to be passed on to the daemon jobs.
+var secrets map[string]interface{}
+
+// fromSecrets are the long names of the options set from the bundle.
+var fromSecrets = make(map[string]bool)
+
+// loadSecrets decrypts the --secrets bundle in memory, or reads the bundle
+// passed by the daemon on the descriptor of SECRETS_FD. The bundle is a
+// YAML map of long option names to values, encrypted with age or sops.
+func loadSecrets(args []string) error {
+	if fd := os.Getenv(secretsFdEnv); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return fmt.Errorf("%s: %v", secretsFdEnv, err)
+		}
+		f := os.NewFile(uintptr(n), "secrets")
+		defer f.Close()
+		dec := json.NewDecoder(f)
+		dec.UseNumber()
+		if err := dec.Decode(&secrets); err != nil {
+			return fmt.Errorf("secrets from the daemon: %v", err)
+		}
+		return nil
+	}
+	var so secretsOptions
+	if _, err := flags.NewParser(&so, flags.IgnoreUnknown).ParseArgs(args); err != nil {
+		return err
+	}
+	if so.Secrets == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(so.Secrets)
+	if err != nil {
+		return err
+	}
+	if data, err = decryptSecrets(data, so.Identities); err != nil {
+		return fmt.Errorf("%s: %v", so.Secrets, err)
+	}
+	if err := yaml.Unmarshal(data, &secrets); err != nil {
+		return fmt.Errorf("%s: %v", so.Secrets, err)
+	}
+	envs := optionEnvs()
+	for name := range secrets {
+		if _, ok := envs[name]; !ok {
+			return fmt.Errorf("%s: unknown option %q", so.Secrets, name)
+		}
+	}
+	return nil
+}
+
+// applySecrets assigns the values of the bundle to the options given
+// neither on the command line nor in the environment. The values never
+// go through the environment, where the daemon jobs and /proc would see
+// them.
+func applySecrets(parser *flags.Parser) error {
+	envs := optionEnvs()
+	for name, value := range secrets {
+		if o := parser.FindOptionByLongName(name); o != nil && o.IsSet() && !o.IsSetDefault() {
+			continue
+		}
+		if _, set := os.LookupEnv(envs[name]); set {
+			continue
+		}
+		if err := setOption(name, value); err != nil {
+			return fmt.Errorf("secrets: %s: %v", name, err)
+		}
+		fromSecrets[name] = true
+	}
+	return nil
+}
+
+// setOption assigns a bundle value, a scalar or a list, to the global
+// option of long name.
+func setOption(name string, value interface{}) error {
+	var values []string
+	if list, ok := value.([]interface{}); ok {
+		for _, item := range list {
+			values = append(values, fmt.Sprint(item))
+		}
+	} else {
+		values = []string{fmt.Sprint(value)}
+	}
+	v := reflect.ValueOf(&opts).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("long") != name {
+			continue
+		}
+		f := v.Field(i)
+		if f.Kind() == reflect.Slice {
+			if len(values) == 1 && t.Field(i).Tag.Get("env-delim") != "" {
+				values = strings.Split(values[0], t.Field(i).Tag.Get("env-delim"))
+			}
+			f.Set(reflect.ValueOf(values))
+			return nil
+		}
+		if len(values) != 1 {
+			return fmt.Errorf("expected a single value")
+		}
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(values[0])
+		case reflect.Bool:
+			b, err := strconv.ParseBool(values[0])
+			if err != nil {
+				return err
+			}
+			f.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(values[0], 10, 64)
+			if err != nil {
+				return err
+			}
+			f.SetInt(n)
+		case reflect.Uint, reflect.Uint64:
+			n, err := strconv.ParseUint(values[0], 10, 64)
+			if err != nil {
+				return err
+			}
+			f.SetUint(n)
+		default:
+			return fmt.Errorf("unsupported type %s", f.Type())
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown option")
+}
+
+// jobSecrets returns the bundle passed to a daemon job, without the sweep
+// options unless sweep is set.
+func jobSecrets(sweep bool) map[string]interface{} {
+	bundle := make(map[string]interface{})
+	for name, value := range secrets {
+		bundle[name] = value
+	}
+	if !sweep {
+		for _, name := range sweepOptions {
+			delete(bundle, name)
+		}
+	}
+	return bundle
+}
+
+// decryptSecrets returns the plaintext of an age or sops encrypted bundle.
+// Without an identity file, the age passphrase is prompted for.
+func decryptSecrets(data []byte, identityFiles []string) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(ageHeader)) {
+		var doc map[string]interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		if _, ok := doc["sops"]; !ok {
+			return nil, fmt.Errorf("secrets bundle is neither age nor sops encrypted")
+		}
+		if len(identityFiles) > 0 && os.Getenv("SOPS_AGE_KEY_FILE") == "" {
+			// sops only reads age identities from its environment: set it
+			// for the decryption only, so that it reaches no child.
+			os.Setenv("SOPS_AGE_KEY_FILE", identityFiles[0])
+			defer os.Unsetenv("SOPS_AGE_KEY_FILE")
+		}
+		return decrypt.Data(data, "yaml")
+	}
+
+	var ids []age.Identity
+	for _, path := range identityFiles {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		fileIds, err := age.ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		ids = append(ids, fileIds...)
+	}
+	if len(ids) == 0 {
+		fmt.Fprint(os.Stderr, "Secrets passphrase: ")
+		passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		id, err := age.NewScryptIdentity(string(passphrase))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	r, err := age.Decrypt(bytes.NewReader(data), ids...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// optionEnvs maps the long name of every global option to its environment
+// variable.
+func optionEnvs() map[string]string {
+	envs := make(map[string]string)
+	t := reflect.TypeOf(opts)
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag
+		if long, env := tag.Get("long"), tag.Get("env"); long != "" && env != "" {
+			envs[long] = env
+		}
+	}
+	return envs
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// decodeKey decodes a Base64URL encoded private key, padding optional.
+func decodeKey(privateKey string) (*ecdsa.PrivateKey, error) {
+	str := strings.TrimSpace(privateKey)
+	if strings.ContainsAny(str, "+/") {
+		return nil, errors.New("invalid base64url encoding")
+	}
+	str = strings.Replace(str, "-", "+", -1)
+	str = strings.Replace(str, "_", "/", -1)
+	for len(str)%4 != 0 {
+		str += "="
+	}
+	pkey, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.ToECDSA(pkey)
+}
+
+// encodeKey returns the base64url encoding of key, the inverse of
+// decodeKey.
+func encodeKey(key *ecdsa.PrivateKey) string {
+	return base64.RawURLEncoding.EncodeToString(crypto.FromECDSA(key))
+}
+
+// readKeys sends every key of r, one per line, to accounts. Blank lines and
+// lines starting with # are skipped.
+func readKeys(ctx context.Context, name string, r io.Reader, accounts chan<- account) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		str := strings.TrimSpace(scanner.Text())
+		if str == "" || strings.HasPrefix(str, "#") {
+			continue
+		}
+		key, err := decodeKey(str)
+		if err != nil {
+			return fmt.Errorf("%s:%d: bad private key: %v", name, line, err)
+		}
+		select {
+		case accounts <- keyAccount(key):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return scanner.Err()
+}
+
+// streamAccounts sends the keys given on the command line, the content of
+// every key file and the used accounts of the mnemonic and xpubs to
+// accounts, and closes it. A key file named "-" is stdin.
+func streamAccounts(ctx context.Context, chains []*chain, contractAddresses []common.Address, accounts chan<- account) error {
+	defer close(accounts)
+	for _, privateKey := range opts.PrivateKeys {
+		key, err := decodeKey(privateKey)
+		if err != nil {
+			log.Println("Bad private key, got:", privateKey, "->")
+			return err
+		}
+		select {
+		case accounts <- keyAccount(key):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for _, smartAccount := range opts.SmartAccounts {
+		acc, err := parseSmartAccount(smartAccount)
+		if err != nil {
+			return err
+		}
+		select {
+		case accounts <- acc:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := streamForwarders(ctx, chains, accounts); err != nil {
+		return err
+	}
+	for _, keyFile := range opts.KeyFiles {
+		if keyFile == "-" {
+			if err := readKeys(ctx, "stdin", os.Stdin, accounts); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := openFile(keyFile)
+		if err != nil {
+			return err
+		}
+		err = readKeys(ctx, keyFile, f, accounts)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if opts.Mnemonic != "" {
+		if err := streamMnemonic(ctx, chains, contractAddresses, accounts); err != nil {
+			return err
+		}
+	}
+	for _, xpub := range opts.XPubs {
+		if err := streamXPub(ctx, chains, xpub, contractAddresses, accounts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resultWriter serializes results coming from concurrent scanners and
+// flushes them as soon as they are written.
+type resultWriter struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+	c  io.Closer
+}
+
+func newResultWriter(path string) (*resultWriter, error) {
+	if path == "" || path == "-" {
+		return &resultWriter{w: bufio.NewWriter(os.Stdout)}, nil
+	}
+	f, err := createFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &resultWriter{w: bufio.NewWriter(f), c: f}, nil
+}
+
+// Write writes a block of output atomically with regard to other writers.
+func (rw *resultWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	n, err := rw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, rw.w.Flush()
+}
+
+func (rw *resultWriter) Close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	err := rw.w.Flush()
+	if rw.c != nil {
+		if cerr := rw.c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// progress counts processed keys and logs every n of them.
+type progress struct {
+	n     uint64
+	count uint64
+}
+
+func (p *progress) Done() {
+	count := atomic.AddUint64(&p.count, 1)
+	if p.n != 0 && count%p.n == 0 {
+		log.Printf("Processed %d keys", count)
+	}
+}
+
+func (p *progress) Total() uint64 {
+	return atomic.LoadUint64(&p.count)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func FuzzDecodeKey(f *testing.F) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, s := range []string{encodeKey(key), encodeKey(key) + "=", "", "=", "AAAA", "a+b/", "-_-_", " \n"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		key, err := decodeKey(s)
+		if err != nil {
+			return
+		}
+		again, err := decodeKey(encodeKey(key))
+		if err != nil {
+			t.Fatalf("decodeKey(encodeKey(%q)): %v", s, err)
+		}
+		if !bytes.Equal(crypto.FromECDSA(again), crypto.FromECDSA(key)) {
+			t.Fatalf("%q does not round-trip", s)
+		}
+	})
+}
+
+func TestEncodeDecodeKey(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeKey(encodeKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(crypto.FromECDSA(got), crypto.FromECDSA(key)) {
+			t.Fatalf("key %d does not round-trip", i)
+		}
+	}
+}
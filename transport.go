@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/event"
+)
+
+// maxReconnectDelay caps the backoff between two reconnection attempts.
+const maxReconnectDelay = time.Minute
+
+// isPersistent tells whether url is a ws, wss or IPC endpoint, the ones
+// subscriptions can be made on.
+func isPersistent(url string) bool {
+	return strings.HasPrefix(url, "ws://") || strings.HasPrefix(url, "wss://") ||
+		!strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://")
+}
+
+// transport is a ws, wss or IPC connection checked every heartbeat and
+// redialed with backoff once it fails.
+type transport struct {
+	url       string
+	heartbeat time.Duration
+
+	mu     sync.Mutex
+	client *ethclient.Client
+	// down is closed when client fails.
+	down chan struct{}
+	// up is closed once a client is connected again.
+	up chan struct{}
+}
+
+// dialTransport connects to url and keeps the connection alive until ctx
+// is done.
+func dialTransport(ctx context.Context, url string, heartbeat time.Duration) (*transport, error) {
+	c, err := dialEthClient(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	t := &transport{url: url, heartbeat: heartbeat, client: c, down: make(chan struct{}), up: make(chan struct{})}
+	close(t.up)
+	go t.run(ctx)
+	return t, nil
+}
+
+// conn waits for a connected client and returns it with a channel closed
+// when it fails.
+func (t *transport) conn(ctx context.Context) (*ethclient.Client, <-chan struct{}, error) {
+	for {
+		t.mu.Lock()
+		c, down, up := t.client, t.down, t.up
+		t.mu.Unlock()
+		if c != nil {
+			return c, down, nil
+		}
+		select {
+		case <-up:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// fail reports an error of c, which is closed and redialed if it is still
+// the current client.
+func (t *transport) fail(c *ethclient.Client, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client != c || c == nil {
+		return
+	}
+	log.Printf("Connection to %s lost: %v", redactURL(t.url), redactError(err, t.url))
+	c.Close()
+	t.client = nil
+	t.up = make(chan struct{})
+	close(t.down)
+}
+
+// run checks the connection every heartbeat and redials it once failed.
+func (t *transport) run(ctx context.Context) {
+	ticker := time.NewTicker(t.heartbeat)
+	defer ticker.Stop()
+	delay := time.Second
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			t.mu.Lock()
+			if t.client != nil {
+				t.client.Close()
+			}
+			t.mu.Unlock()
+			return
+		}
+		t.mu.Lock()
+		c := t.client
+		t.mu.Unlock()
+		if c != nil {
+			hctx, cancel := context.WithTimeout(ctx, t.heartbeat)
+			_, err := c.HeaderByNumber(hctx, nil)
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				t.fail(c, err)
+			}
+			continue
+		}
+		c, err := dialEthClient(ctx, t.url)
+		if err != nil {
+			log.Printf("Reconnecting to %s: %v, retrying in %s", redactURL(t.url), redactError(err, t.url), delay)
+			ticker.Reset(delay)
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+		log.Printf("Reconnected to %s", redactURL(t.url))
+		delay = time.Second
+		ticker.Reset(t.heartbeat)
+		// Only run replaces the client and it is nil here: fail closed the
+		// client it replaces.
+		t.mu.Lock()
+		t.client = c
+		t.down = make(chan struct{})
+		close(t.up)
+		t.mu.Unlock()
+	}
+}
+
+// logKey identifies a log across subscriptions and backfills.
+type logKey struct {
+	tx    common.Hash
+	index uint
+}
+
+// watchTransfers sends the transfers of the tokens to the addresses to sink
+// until ctx is done. The subscriptions are made again after every
+// reconnection of t and the blocks missed meanwhile are backfilled with
+// FilterTransfer from the last block seen.
+func watchTransfers(ctx context.Context, t *transport, tokens, to []common.Address, sink chan<- *ERC20Transfer) error {
+	var last uint64
+	seen := make(map[logKey]uint64)
+	deliver := func(ev *ERC20Transfer) bool {
+		key := logKey{ev.Raw.TxHash, ev.Raw.Index}
+		if _, ok := seen[key]; ok || ev.Raw.Removed {
+			return true
+		}
+		seen[key] = ev.Raw.BlockNumber
+		if ev.Raw.BlockNumber > last {
+			last = ev.Raw.BlockNumber
+		}
+		select {
+		case sink <- ev:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	for {
+		c, down, err := t.conn(ctx)
+		if err != nil {
+			return err
+		}
+		logs := make(chan *ERC20Transfer, 64)
+		var subs []event.Subscription
+		errs := make(chan error, 1)
+		unsubscribe := func() {
+			for _, sub := range subs {
+				sub.Unsubscribe()
+			}
+		}
+		subscribed := true
+		for _, token := range tokens {
+			filterer, err := NewERC20Filterer(token, c)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < len(to); i += maxTopicAddresses {
+				j := i + maxTopicAddresses
+				if j > len(to) {
+					j = len(to)
+				}
+				sub, err := filterer.WatchTransfer(&bind.WatchOpts{Context: ctx}, logs, nil, to[i:j])
+				if err != nil {
+					t.fail(c, err)
+					subscribed = false
+					break
+				}
+				subs = append(subs, sub)
+				go func(sub event.Subscription) {
+					if err, ok := <-sub.Err(); ok && err != nil {
+						select {
+						case errs <- err:
+						default:
+						}
+					}
+				}(sub)
+			}
+			if !subscribed {
+				break
+			}
+		}
+		if subscribed {
+			// The subscriptions are live, fill the gap up to the head.
+			if err := backfillTransfers(ctx, c, tokens, to, &last, deliver); err != nil {
+				t.fail(c, err)
+				subscribed = false
+			}
+		}
+		for subscribed {
+			select {
+			case ev := <-logs:
+				if !deliver(ev) {
+					unsubscribe()
+					return ctx.Err()
+				}
+			case err := <-errs:
+				t.fail(c, err)
+				subscribed = false
+			case <-down:
+				subscribed = false
+			case <-ctx.Done():
+				unsubscribe()
+				return ctx.Err()
+			}
+		}
+		unsubscribe()
+		for key, block := range seen {
+			if block+1024 < last {
+				delete(seen, key)
+			}
+		}
+	}
+}
+
+// backfillTransfers delivers the transfers from the block *last, or the
+// head when nothing was seen yet, to the head.
+func backfillTransfers(ctx context.Context, c *ethclient.Client, tokens, to []common.Address, last *uint64, deliver func(*ERC20Transfer) bool) error {
+	head, err := c.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return err
+	}
+	end := head.Number.Uint64()
+	if *last == 0 {
+		*last = end
+		return nil
+	}
+	start := *last
+	if start > end {
+		return nil
+	}
+	log.Printf("Backfilling transfers of blocks %d to %d", start, end)
+	for _, token := range tokens {
+		filterer, err := NewERC20Filterer(token, c)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(to); i += maxTopicAddresses {
+			j := i + maxTopicAddresses
+			if j > len(to) {
+				j = len(to)
+			}
+			it, err := filterer.FilterTransfer(&bind.FilterOpts{Start: start, End: &end, Context: ctx}, nil, to[i:j])
+			if err != nil {
+				return err
+			}
+			for it.Next() {
+				if !deliver(it.Event) {
+					it.Close()
+					return ctx.Err()
+				}
+			}
+			err = it.Error()
+			it.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if end > *last {
+		*last = end
+	}
+	return nil
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// EntryPointV06 is the address of the ERC-4337 v0.6 EntryPoint.
+const EntryPointV06 = "0x5FF137D4b0FDCD49DcA30c7CF57E578a026d2789"
+
+// SmartAccountABI is the execution interface of SimpleAccount compatible
+// smart accounts.
+const SmartAccountABI = `[{"inputs":[{"name":"dest","type":"address"},{"name":"value","type":"uint256"},{"name":"func","type":"bytes"}],"name":"execute","outputs":[],"stateMutability":"nonpayable","type":"function"},{"inputs":[{"name":"dest","type":"address[]"},{"name":"func","type":"bytes[]"}],"name":"executeBatch","outputs":[],"stateMutability":"nonpayable","type":"function"}]`
+
+// EntryPointABI is the part of the EntryPoint interface used to get nonces.
+const EntryPointABI = `[{"inputs":[{"name":"sender","type":"address"},{"name":"key","type":"uint192"}],"name":"getNonce","outputs":[{"name":"nonce","type":"uint256"}],"stateMutability":"view","type":"function"}]`
+
+// userOperation is an ERC-4337 v0.6 user operation.
+type userOperation struct {
+	Sender               common.Address `json:"sender"`
+	Nonce                *hexutil.Big   `json:"nonce"`
+	InitCode             hexutil.Bytes  `json:"initCode"`
+	CallData             hexutil.Bytes  `json:"callData"`
+	CallGasLimit         *hexutil.Big   `json:"callGasLimit"`
+	VerificationGasLimit *hexutil.Big   `json:"verificationGasLimit"`
+	PreVerificationGas   *hexutil.Big   `json:"preVerificationGas"`
+	MaxFeePerGas         *hexutil.Big   `json:"maxFeePerGas"`
+	MaxPriorityFeePerGas *hexutil.Big   `json:"maxPriorityFeePerGas"`
+	PaymasterAndData     hexutil.Bytes  `json:"paymasterAndData"`
+	Signature            hexutil.Bytes  `json:"signature"`
+}
+
+// word left pads b to a 32 bytes ABI word.
+func word(b []byte) []byte {
+	return common.LeftPadBytes(b, 32)
+}
+
+// hash returns the hash of op signed by the owner of the smart account.
+func (op *userOperation) hash(entryPoint common.Address, chainId *big.Int) common.Hash {
+	packed := crypto.Keccak256(
+		word(op.Sender.Bytes()),
+		word(op.Nonce.ToInt().Bytes()),
+		crypto.Keccak256(op.InitCode),
+		crypto.Keccak256(op.CallData),
+		word(op.CallGasLimit.ToInt().Bytes()),
+		word(op.VerificationGasLimit.ToInt().Bytes()),
+		word(op.PreVerificationGas.ToInt().Bytes()),
+		word(op.MaxFeePerGas.ToInt().Bytes()),
+		word(op.MaxPriorityFeePerGas.ToInt().Bytes()),
+		crypto.Keccak256(op.PaymasterAndData),
+	)
+	return crypto.Keccak256Hash(packed, word(entryPoint.Bytes()), word(chainId.Bytes()))
+}
+
+// sign signs op with the owner key as an Ethereum signed message.
+func (op *userOperation) sign(owner *ecdsa.PrivateKey, entryPoint common.Address, chainId *big.Int) error {
+	hash := op.hash(entryPoint, chainId)
+	msg := crypto.Keccak256([]byte("\x19Ethereum Signed Message:\n32"), hash.Bytes())
+	sig, err := crypto.Sign(msg, owner)
+	if err != nil {
+		return err
+	}
+	sig[64] += 27
+	op.Signature = sig
+	return nil
+}
+
+// maxCost returns the most op can be charged for gas.
+func (op *userOperation) maxCost() *big.Int {
+	gas := new(big.Int).Add(op.CallGasLimit.ToInt(), op.VerificationGasLimit.ToInt())
+	gas.Add(gas, op.PreVerificationGas.ToInt())
+	return gas.Mul(gas, op.MaxFeePerGas.ToInt())
+}
+
+// bundler submits user operations of one chain.
+type bundler struct {
+	client     *rpc.Client
+	paymaster  *rpc.Client
+	entryPoint common.Address
+}
+
+// bundlers are the bundlers of every network id, see --bundler-url.
+var bundlers = make(map[string]*bundler)
+
+// dialBundlers connects to every --bundler-url and --paymaster-url. A url
+// prefixed with a network id and = only applies to that network.
+func dialBundlers(ctx context.Context) error {
+	entryPoint := opts.EntryPoint
+	if entryPoint == "" {
+		entryPoint = EntryPointV06
+	}
+	paymasters := make(map[string]*rpc.Client)
+	for _, u := range opts.PaymasterURLs {
+		networkId, url := splitNetworkURL(u)
+		c, err := dialRPC(ctx, url)
+		if err != nil {
+			return err
+		}
+		paymasters[networkId] = c
+	}
+	for _, u := range opts.BundlerURLs {
+		networkId, url := splitNetworkURL(u)
+		c, err := dialRPC(ctx, url)
+		if err != nil {
+			return err
+		}
+		b := &bundler{client: c, paymaster: paymasters[networkId], entryPoint: common.HexToAddress(entryPoint)}
+		if b.paymaster == nil {
+			b.paymaster = paymasters[""]
+		}
+		bundlers[networkId] = b
+	}
+	return nil
+}
+
+func splitNetworkURL(u string) (string, string) {
+	if i := strings.Index(u, "="); i > 0 && !strings.Contains(u[:i], "/") {
+		return u[:i], u[i+1:]
+	}
+	return "", u
+}
+
+// bundlerFor returns the bundler of the network of ch, nil if none.
+func bundlerFor(ch *chain) *bundler {
+	if b, ok := bundlers[ch.networkId.String()]; ok {
+		return b
+	}
+	return bundlers[""]
+}
+
+// sponsor asks the paymaster to pay for op, filling its gas limits and
+// paymasterAndData.
+func (b *bundler) sponsor(ctx context.Context, op *userOperation) error {
+	var res struct {
+		PaymasterAndData     hexutil.Bytes `json:"paymasterAndData"`
+		PreVerificationGas   *hexutil.Big  `json:"preVerificationGas"`
+		VerificationGasLimit *hexutil.Big  `json:"verificationGasLimit"`
+		CallGasLimit         *hexutil.Big  `json:"callGasLimit"`
+	}
+	if err := b.paymaster.CallContext(ctx, &res, "pm_sponsorUserOperation", op, b.entryPoint); err != nil {
+		return err
+	}
+	op.PaymasterAndData = res.PaymasterAndData
+	if res.PreVerificationGas != nil {
+		op.PreVerificationGas = res.PreVerificationGas
+	}
+	if res.VerificationGasLimit != nil {
+		op.VerificationGasLimit = res.VerificationGasLimit
+	}
+	if res.CallGasLimit != nil {
+		op.CallGasLimit = res.CallGasLimit
+	}
+	return nil
+}
+
+// estimate fills the gas limits of op.
+func (b *bundler) estimate(ctx context.Context, op *userOperation) error {
+	var res struct {
+		PreVerificationGas   *hexutil.Big `json:"preVerificationGas"`
+		VerificationGasLimit *hexutil.Big `json:"verificationGasLimit"`
+		CallGasLimit         *hexutil.Big `json:"callGasLimit"`
+	}
+	if err := b.client.CallContext(ctx, &res, "eth_estimateUserOperationGas", op, b.entryPoint); err != nil {
+		return err
+	}
+	if res.PreVerificationGas == nil || res.VerificationGasLimit == nil || res.CallGasLimit == nil {
+		return errors.New("incomplete gas estimation")
+	}
+	op.PreVerificationGas = res.PreVerificationGas
+	op.VerificationGasLimit = res.VerificationGasLimit
+	op.CallGasLimit = res.CallGasLimit
+	return nil
+}
+
+// send submits op and returns its hash.
+func (b *bundler) send(ctx context.Context, op *userOperation) (common.Hash, error) {
+	var hash common.Hash
+	err := b.client.CallContext(ctx, &hash, "eth_sendUserOperation", op, b.entryPoint)
+	return hash, err
+}
+
+// userOperationReceipt is the part of eth_getUserOperationReceipt used.
+type userOperationReceipt struct {
+	Success bool   `json:"success"`
+	Reason  string `json:"reason"`
+	Receipt struct {
+		TransactionHash common.Hash  `json:"transactionHash"`
+		BlockNumber     *hexutil.Big `json:"blockNumber"`
+	} `json:"receipt"`
+}
+
+// userOpPoll is the interval of the receipt polls of wait and
+// userOpTimeout how long it waits for an operation to be included.
+var (
+	userOpPoll    = 2 * time.Second
+	userOpTimeout = 10 * time.Minute
+)
+
+// wait polls the bundler until the operation hash is included, or fails
+// after userOpTimeout.
+func (b *bundler) wait(ctx context.Context, hash common.Hash) (*userOperationReceipt, error) {
+	ctx, cancel := context.WithTimeout(ctx, userOpTimeout)
+	defer cancel()
+	ticker := time.NewTicker(userOpPoll)
+	defer ticker.Stop()
+	for {
+		var receipt *userOperationReceipt
+		err := b.client.CallContext(ctx, &receipt, "eth_getUserOperationReceipt", hash)
+		if err == nil && receipt != nil {
+			return receipt, nil
+		}
+		if err == nil {
+			select {
+			case <-ticker.C:
+				continue
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("user operation %s not included after %s", hash.Hex(), userOpTimeout)
+		}
+		return nil, err
+	}
+}
+
+// newUserOperation returns an unsigned operation of sender running callData
+// with the nonce of nonceKey and the current gas price.
+func newUserOperation(ctx context.Context, ch *chain, b *bundler, sender common.Address, nonceKey int64, callData []byte) (*userOperation, error) {
+	parsed, err := abi.JSON(strings.NewReader(EntryPointABI))
+	if err != nil {
+		return nil, err
+	}
+	entryPoint := bind.NewBoundContract(b.entryPoint, parsed, ch.client, ch.client, ch.client)
+	nonce := new(big.Int)
+	if err := entryPoint.Call(&bind.CallOpts{Context: ctx}, &nonce, "getNonce", sender, big.NewInt(nonceKey)); err != nil {
+		return nil, err
+	}
+	gasPrice, err := ch.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	zero := (*hexutil.Big)(new(big.Int))
+	return &userOperation{
+		Sender:               sender,
+		Nonce:                (*hexutil.Big)(nonce),
+		CallData:             callData,
+		CallGasLimit:         zero,
+		VerificationGasLimit: zero,
+		PreVerificationGas:   zero,
+		MaxFeePerGas:         (*hexutil.Big)(gasPrice),
+		MaxPriorityFeePerGas: (*hexutil.Big)(gasPrice),
+		// Dummy signature of the right length for gas estimation.
+		Signature: append(make([]byte, 64), 27),
+	}, nil
+}
+
+// submit prices, signs and sends op then waits for its inclusion. It
+// returns the hash of the transaction including op.
+func (b *bundler) submit(ctx context.Context, ch *chain, op *userOperation, owner *ecdsa.PrivateKey) (common.Hash, error) {
+	var err error
+	if b.paymaster != nil {
+		err = b.sponsor(ctx, op)
+	} else if op.CallGasLimit.ToInt().Sign() == 0 {
+		err = b.estimate(ctx, op)
+	}
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if err := halted(); err != nil {
+		return common.Hash{}, err
+	}
+	if err := op.sign(owner, b.entryPoint, ch.networkId); err != nil {
+		return common.Hash{}, err
+	}
+	audit("sign", map[string]string{"network_id": ch.networkId.String(), "sender": op.Sender.Hex(), "user_operation": op.hash(b.entryPoint, ch.networkId).Hex()})
+	hash, err := b.send(ctx, op)
+	if err != nil {
+		audit("broadcast", map[string]string{"network_id": ch.networkId.String(), "sender": op.Sender.Hex(), "error": redactRPCError(err).Error()})
+		return common.Hash{}, err
+	}
+	audit("broadcast", map[string]string{"network_id": ch.networkId.String(), "sender": op.Sender.Hex(), "user_operation": hash.Hex()})
+	log.Printf("Swipping smart account %s [user operation %s]", op.Sender.Hex(), hash.Hex())
+	receipt, err := b.wait(ctx, hash)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if !receipt.Success {
+		return common.Hash{}, fmt.Errorf("user operation %s reverted: %s", hash.Hex(), receipt.Reason)
+	}
+	log.Printf("User operation %s included [%s]", hash.Hex(), receipt.Receipt.TransactionHash.Hex())
+	return receipt.Receipt.TransactionHash, nil
+}
+
+// tokenBalance is a non-zero ERC20 balance to sweep.
+type tokenBalance struct {
+	token  common.Address
+	amount *big.Int
+}
+
+// SwipeSmartAccount sweeps the tokens and the ether of the ERC-4337 smart
+// account sender, owned by owner, to `to` through the bundler of ch. The
+// tokens are moved in one batched operation and the ether, less the gas
+// unless a paymaster pays for it, in a second one using another nonce key.
+// value is the balance found by the scan; the ether left after the token
+// operation paid its gas is read again before the second one.
+func SwipeSmartAccount(ctx context.Context, ch *chain, sender common.Address, owner *ecdsa.PrivateKey, to common.Address, tokens []tokenBalance, value *big.Int) error {
+	b := bundlerFor(ch)
+	if b == nil {
+		return fmt.Errorf("no bundler for network %s, use --bundler-url", ch.networkId)
+	}
+	account, err := abi.JSON(strings.NewReader(SmartAccountABI))
+	if err != nil {
+		return err
+	}
+	erc20, err := abi.JSON(strings.NewReader(ERC20ABI))
+	if err != nil {
+		return err
+	}
+
+	if len(tokens) > 0 {
+		var dests []common.Address
+		var calls [][]byte
+		for _, t := range tokens {
+			call, err := erc20.Pack("transfer", to, t.amount)
+			if err != nil {
+				return err
+			}
+			dests = append(dests, t.token)
+			calls = append(calls, call)
+		}
+		callData, err := account.Pack("executeBatch", dests, calls)
+		if err != nil {
+			return err
+		}
+		op, err := newUserOperation(ctx, ch, b, sender, 0, callData)
+		if err != nil {
+			return err
+		}
+		tx, err := b.submit(ctx, ch, op, owner)
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			recordSweep(ch, sender, t.token.Hex(), tx)
+		}
+		if value, err = ch.client.BalanceAt(ctx, sender, nil); err != nil {
+			return err
+		}
+	}
+
+	if value == nil || value.Sign() == 0 {
+		return nil
+	}
+	callData, err := account.Pack("execute", to, value, []byte{})
+	if err != nil {
+		return err
+	}
+	op, err := newUserOperation(ctx, ch, b, sender, 1, callData)
+	if err != nil {
+		return err
+	}
+	if b.paymaster == nil {
+		// Estimate with the full value, then leave the prefund.
+		if err := b.estimate(ctx, op); err != nil {
+			return err
+		}
+		remaining := new(big.Int).Sub(value, op.maxCost())
+		if remaining.Sign() <= 0 {
+			log.Printf("Smart account %s: balance %s does not cover the gas %s", sender.Hex(), value, op.maxCost())
+			return nil
+		}
+		if op.CallData, err = account.Pack("execute", to, remaining, []byte{}); err != nil {
+			return err
+		}
+	}
+	tx, err := b.submit(ctx, ch, op, owner)
+	if err != nil {
+		return err
+	}
+	recordSweep(ch, sender, "ETH", tx)
+	return nil
+}
+
+// parseSmartAccount parses a --smart-account value, the account address and
+// the Base64URL encoded owner key separated by a colon.
+func parseSmartAccount(s string) (account, error) {
+	i := strings.Index(s, ":")
+	if i < 0 || !common.IsHexAddress(s[:i]) {
+		return account{}, fmt.Errorf("invalid smart account %q, expected address:key", s)
+	}
+	owner, err := decodeKey(s[i+1:])
+	if err != nil {
+		return account{}, err
+	}
+	return account{address: common.HexToAddress(s[:i]), owner: owner}, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// rpcStub answers JSON-RPC methods, serving both the node and the bundler.
+type rpcStub map[string]func(params []json.RawMessage) (interface{}, error)
+
+// dial starts an HTTP server for the stub and returns a client of it.
+func (s rpcStub) dial(t *testing.T) *rpc.Client {
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+		mu.Lock()
+		f, ok := s[req.Method]
+		if !ok {
+			res["error"] = map[string]interface{}{"code": -32601, "message": "no method " + req.Method}
+		} else if result, err := f(req.Params); err != nil {
+			res["error"] = map[string]interface{}{"code": -32000, "message": err.Error()}
+		} else {
+			res["result"] = result
+		}
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}))
+	t.Cleanup(srv.Close)
+	c, err := rpc.DialContext(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func hexBig(n int64) *hexutil.Big {
+	return (*hexutil.Big)(big.NewInt(n))
+}
+
+// estimateStub fills the gas of the stubbed estimations.
+func estimateStub(params []json.RawMessage) (interface{}, error) {
+	return map[string]interface{}{
+		"preVerificationGas":   hexBig(50000),
+		"verificationGasLimit": hexBig(100000),
+		"callGasLimit":         hexBig(21000),
+	}, nil
+}
+
+func testOperation() *userOperation {
+	return &userOperation{
+		Sender:               common.HexToAddress("0x1000000000000000000000000000000000000001"),
+		Nonce:                hexBig(0),
+		CallData:             []byte{1, 2, 3},
+		CallGasLimit:         hexBig(0),
+		VerificationGasLimit: hexBig(0),
+		PreVerificationGas:   hexBig(0),
+		MaxFeePerGas:         hexBig(1e9),
+		MaxPriorityFeePerGas: hexBig(1e9),
+		Signature:            append(make([]byte, 64), 27),
+	}
+}
+
+func TestUserOperationSign(t *testing.T) {
+	owner, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entryPoint := common.HexToAddress(EntryPointV06)
+	op := testOperation()
+	if err := op.sign(owner, entryPoint, big.NewInt(1)); err != nil {
+		t.Fatal(err)
+	}
+	hash := op.hash(entryPoint, big.NewInt(1))
+	msg := crypto.Keccak256([]byte("\x19Ethereum Signed Message:\n32"), hash.Bytes())
+	sig := append([]byte{}, op.Signature...)
+	if sig[64] != 27 && sig[64] != 28 {
+		t.Fatalf("v = %d, want 27 or 28", sig[64])
+	}
+	sig[64] -= 27
+	pub, err := crypto.SigToPub(msg, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := crypto.PubkeyToAddress(*pub), crypto.PubkeyToAddress(owner.PublicKey); got != want {
+		t.Errorf("signed by %s, want %s", got.Hex(), want.Hex())
+	}
+	if op.hash(entryPoint, big.NewInt(5)) == hash {
+		t.Error("hash does not depend on the chain id")
+	}
+	if op.hash(common.HexToAddress("0x0576a174D229E3cFA37253523E645A78A0C91B57"), big.NewInt(1)) == hash {
+		t.Error("hash does not depend on the EntryPoint")
+	}
+}
+
+func TestBundlerEstimate(t *testing.T) {
+	var entryPoint common.Address
+	c := rpcStub{"eth_estimateUserOperationGas": func(params []json.RawMessage) (interface{}, error) {
+		if len(params) != 2 {
+			t.Fatalf("%d params, want the operation and the EntryPoint", len(params))
+		}
+		if err := json.Unmarshal(params[1], &entryPoint); err != nil {
+			t.Fatal(err)
+		}
+		return estimateStub(params)
+	}}.dial(t)
+	b := &bundler{client: c, entryPoint: common.HexToAddress(EntryPointV06)}
+	op := testOperation()
+	if err := b.estimate(context.Background(), op); err != nil {
+		t.Fatal(err)
+	}
+	if entryPoint != b.entryPoint {
+		t.Errorf("estimated against %s, want %s", entryPoint.Hex(), b.entryPoint.Hex())
+	}
+	if op.PreVerificationGas.ToInt().Int64() != 50000 || op.VerificationGasLimit.ToInt().Int64() != 100000 || op.CallGasLimit.ToInt().Int64() != 21000 {
+		t.Errorf("gas not filled: %+v", op)
+	}
+	if got, want := op.maxCost(), big.NewInt(171000*1e9); got.Cmp(want) != 0 {
+		t.Errorf("maxCost = %s, want %s", got, want)
+	}
+}
+
+func TestBundlerEstimateIncomplete(t *testing.T) {
+	c := rpcStub{"eth_estimateUserOperationGas": func(params []json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{"callGasLimit": hexBig(21000)}, nil
+	}}.dial(t)
+	b := &bundler{client: c, entryPoint: common.HexToAddress(EntryPointV06)}
+	if err := b.estimate(context.Background(), testOperation()); err == nil {
+		t.Fatal("incomplete estimation accepted")
+	}
+}
+
+func TestBundlerSponsor(t *testing.T) {
+	c := rpcStub{"pm_sponsorUserOperation": func(params []json.RawMessage) (interface{}, error) {
+		return map[string]interface{}{"paymasterAndData": hexutil.Bytes{0xaa, 0xbb}, "callGasLimit": hexBig(30000)}, nil
+	}}.dial(t)
+	b := &bundler{paymaster: c, entryPoint: common.HexToAddress(EntryPointV06)}
+	op := testOperation()
+	if err := b.sponsor(context.Background(), op); err != nil {
+		t.Fatal(err)
+	}
+	if len(op.PaymasterAndData) != 2 || op.CallGasLimit.ToInt().Int64() != 30000 {
+		t.Errorf("sponsorship not applied: %+v", op)
+	}
+	if op.VerificationGasLimit.ToInt().Sign() != 0 {
+		t.Error("missing limit overwritten")
+	}
+}
+
+func TestBundlerWait(t *testing.T) {
+	defer func(poll time.Duration) { userOpPoll = poll }(userOpPoll)
+	userOpPoll = 10 * time.Millisecond
+	polls := 0
+	tx := common.HexToHash("0x01")
+	c := rpcStub{"eth_getUserOperationReceipt": func(params []json.RawMessage) (interface{}, error) {
+		if polls++; polls < 3 {
+			return nil, nil
+		}
+		return map[string]interface{}{"success": true, "receipt": map[string]interface{}{"transactionHash": tx, "blockNumber": hexBig(1)}}, nil
+	}}.dial(t)
+	b := &bundler{client: c, entryPoint: common.HexToAddress(EntryPointV06)}
+	receipt, err := b.wait(context.Background(), common.HexToHash("0x02"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Receipt.TransactionHash != tx || polls != 3 {
+		t.Errorf("receipt %s after %d polls", receipt.Receipt.TransactionHash.Hex(), polls)
+	}
+}
+
+func TestBundlerWaitTimeout(t *testing.T) {
+	defer func(poll, timeout time.Duration) { userOpPoll, userOpTimeout = poll, timeout }(userOpPoll, userOpTimeout)
+	userOpPoll, userOpTimeout = 10*time.Millisecond, 50*time.Millisecond
+	c := rpcStub{"eth_getUserOperationReceipt": func(params []json.RawMessage) (interface{}, error) {
+		return nil, nil
+	}}.dial(t)
+	b := &bundler{client: c, entryPoint: common.HexToAddress(EntryPointV06)}
+	_, err := b.wait(context.Background(), common.HexToHash("0x02"))
+	if err == nil || !strings.Contains(err.Error(), "not included") {
+		t.Fatalf("err = %v, want a timeout", err)
+	}
+}
+
+// TestSwipeSmartAccount checks that the ether operation sweeps the balance
+// left after the token operation paid its gas.
+func TestSwipeSmartAccount(t *testing.T) {
+	const gasPrice = 1e9
+	found := new(big.Int).Mul(big.NewInt(1e9), big.NewInt(1e9))
+	left := new(big.Int).Sub(found, big.NewInt(200000*gasPrice))
+	var ops []userOperation
+	stub := rpcStub{
+		"eth_chainId":  func([]json.RawMessage) (interface{}, error) { return hexBig(1337), nil },
+		"eth_gasPrice": func([]json.RawMessage) (interface{}, error) { return hexBig(gasPrice), nil },
+		"eth_call": func([]json.RawMessage) (interface{}, error) {
+			// getNonce of the EntryPoint.
+			return hexutil.Bytes(word(big.NewInt(int64(len(ops))).Bytes())), nil
+		},
+		"eth_getBalance": func([]json.RawMessage) (interface{}, error) {
+			if len(ops) == 0 {
+				return (*hexutil.Big)(found), nil
+			}
+			return (*hexutil.Big)(left), nil
+		},
+		"eth_estimateUserOperationGas": estimateStub,
+		"eth_sendUserOperation": func(params []json.RawMessage) (interface{}, error) {
+			var op userOperation
+			if err := json.Unmarshal(params[0], &op); err != nil {
+				return nil, err
+			}
+			ops = append(ops, op)
+			return common.BigToHash(big.NewInt(int64(len(ops)))), nil
+		},
+		"eth_getUserOperationReceipt": func([]json.RawMessage) (interface{}, error) {
+			return map[string]interface{}{"success": true, "receipt": map[string]interface{}{"transactionHash": common.HexToHash("0x01"), "blockNumber": hexBig(1)}}, nil
+		},
+	}
+	c := stub.dial(t)
+	defer func(saved map[string]*bundler) { bundlers = saved }(bundlers)
+	bundlers = map[string]*bundler{"": {client: c, entryPoint: common.HexToAddress(EntryPointV06)}}
+	ch := &chain{client: ethclient.NewClient(c), networkId: big.NewInt(1337), tokens: map[common.Address]tokenInfo{}}
+
+	owner, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := common.HexToAddress("0x1000000000000000000000000000000000000001")
+	to := common.HexToAddress("0x2000000000000000000000000000000000000002")
+	tokens := []tokenBalance{{token: common.HexToAddress("0x3000000000000000000000000000000000000003"), amount: big.NewInt(5)}}
+	if err := SwipeSmartAccount(context.Background(), ch, sender, owner, to, tokens, found); err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 2 {
+		t.Fatalf("%d operations sent, want 2", len(ops))
+	}
+
+	account, err := abi.JSON(strings.NewReader(SmartAccountABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err := account.Methods["execute"].Inputs.UnpackValues(ops[1].CallData[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := new(big.Int).Sub(left, ops[1].maxCost())
+	if value := args[1].(*big.Int); value.Cmp(want) != 0 {
+		t.Errorf("swept %s, want %s, the balance left less the gas", value, want)
+	}
+	if ops[1].Nonce.ToInt().Int64() != 1 {
+		t.Errorf("ether operation nonce %s, want 1", ops[1].Nonce.ToInt())
+	}
+}
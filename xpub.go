@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// base58CheckDecode decodes a base58 string and verifies its checksum.
+func base58CheckDecode(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, r := range s {
+		i := strings.IndexRune(base58Alphabet, r)
+		if i < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", r)
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	b := n.Bytes()
+	for _, r := range s {
+		if r != '1' {
+			break
+		}
+		b = append([]byte{0}, b...)
+	}
+	if len(b) < 4 {
+		return nil, errors.New("base58 string too short")
+	}
+	payload, sum := b[:len(b)-4], b[len(b)-4:]
+	h := sha256.Sum256(payload)
+	h = sha256.Sum256(h[:])
+	if !bytes.Equal(h[:4], sum) {
+		return nil, errors.New("invalid base58 checksum")
+	}
+	return payload, nil
+}
+
+// parseXPub parses a BIP-32 serialized extended public key.
+func parseXPub(xpub string) (*extendedKey, error) {
+	b, err := base58CheckDecode(strings.TrimSpace(xpub))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 78 {
+		return nil, fmt.Errorf("invalid extended key length %d", len(b))
+	}
+	if b[45] == 0 {
+		return nil, errors.New("extended private keys are not accepted, use an xpub")
+	}
+	pub, err := crypto.DecompressPubkey(b[45:])
+	if err != nil {
+		return nil, err
+	}
+	return &extendedKey{x: pub.X, y: pub.Y, chainCode: b[13:45]}, nil
+}
+
+// streamXPub walks --xpub-path from xpub and sends the used watch-only
+// accounts to accounts.
+func streamXPub(ctx context.Context, chains []*chain, xpub string, contractAddresses []common.Address, accounts chan<- account) error {
+	root, err := parseXPub(xpub)
+	if err != nil {
+		return err
+	}
+	highest, err := walkGap(ctx, chains, root, opts.XPubPath, opts.GapLimit, contractAddresses, accounts)
+	if err != nil {
+		return err
+	}
+	logHighest(xpub[:12]+"…/"+opts.XPubPath, highest)
+	return nil
+}